@@ -0,0 +1,339 @@
+/*
+Copyright 2017 - The TXTdirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+const (
+	DefaultRecordCacheSize = 1024
+	DefaultRecordCacheTTL  = time.Minute
+	DefaultMaxTTL          = time.Hour
+	DefaultNegativeTTL     = 30 * time.Second
+
+	staleRetryInterval    = time.Second
+	staleRetryMaxInterval = 30 * time.Second
+	staleLookupTimeout    = 5 * time.Second
+
+	// noTTL is the TTL of records whose source doesn't provide one,
+	// the configured TTL is used for them
+	noTTL time.Duration = -1
+)
+
+// RecordCache contains the TXT record cache's configuration
+type RecordCache struct {
+	Enable      bool
+	Size        int
+	TTL         time.Duration
+	MaxTTL      time.Duration
+	NegativeTTL time.Duration
+	Grace       time.Duration
+
+	store *recordStore
+}
+
+// recordStore keeps the TXT lookup results for each absolute zone
+// and evicts the least recently used zone when it's full. Records
+// are kept for the grace window after they expire so they can be
+// served when the resolver is unreachable.
+type recordStore struct {
+	sync.Mutex
+	size    int
+	grace   time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	zone       string
+	txts       []string
+	err        error
+	expires    time.Time
+	refreshing bool
+}
+
+// SetDefaults sets the default values for the record cache config
+// if the fields are empty and creates the cache storage
+func (cache *RecordCache) SetDefaults() {
+	if cache.Size == 0 {
+		cache.Size = DefaultRecordCacheSize
+	}
+	if cache.TTL == 0 {
+		cache.TTL = DefaultRecordCacheTTL
+	}
+	if cache.MaxTTL == 0 {
+		cache.MaxTTL = DefaultMaxTTL
+	}
+	if cache.NegativeTTL == 0 {
+		cache.NegativeTTL = DefaultNegativeTTL
+	}
+	cache.store = newRecordStore(cache.Size, cache.Grace)
+}
+
+// get returns the cached TXT records or lookup error for the given zone
+// if there is an entry for the zone that hasn't expired yet
+func (cache RecordCache) get(zone string) (cacheEntry, bool) {
+	if !cache.Enable || cache.store == nil {
+		return cacheEntry{}, false
+	}
+	return cache.store.get(zone, time.Now())
+}
+
+// set caches the given TXT records for the zone. The TTL returned by
+// the resolver is used when it's available and is capped at MaxTTL.
+// Records with a TTL of zero aren't cached.
+func (cache RecordCache) set(zone string, txts []string, ttl time.Duration) {
+	if !cache.Enable || cache.store == nil {
+		return
+	}
+	if ttl == 0 {
+		cache.store.remove(zone)
+		return
+	}
+	if ttl == noTTL {
+		ttl = cache.TTL
+	}
+	cache.store.set(zone, txts, nil, time.Now().Add(cache.capTTL(ttl)))
+}
+
+// setNegative caches the lookup error for a zone that doesn't exist
+func (cache RecordCache) setNegative(zone string, err error, ttl time.Duration) {
+	if !cache.Enable || cache.store == nil {
+		return
+	}
+	if ttl == 0 {
+		cache.store.remove(zone)
+		return
+	}
+	if ttl == noTTL {
+		ttl = cache.NegativeTTL
+	}
+	cache.store.set(zone, nil, err, time.Now().Add(cache.capTTL(ttl)))
+}
+
+func (cache RecordCache) capTTL(ttl time.Duration) time.Duration {
+	if ttl > cache.MaxTTL {
+		return cache.MaxTTL
+	}
+	return ttl
+}
+
+// stale returns the last records found for the given zone if they
+// have expired but are still inside the grace window.
+// Records are kept unparsed since placeholders in them depend on
+// the request.
+func (cache RecordCache) stale(zone string) (cacheEntry, bool) {
+	if !cache.Enable || cache.store == nil {
+		return cacheEntry{}, false
+	}
+	return cache.store.stale(zone, time.Now())
+}
+
+// revalidate keeps retrying the lookup for the given stale zone in
+// the background until it succeeds or the grace window ends.
+// Only one refresh runs for each zone at a time.
+func (cache RecordCache) revalidate(zone string, c Config) {
+	if !cache.store.startRefresh(zone) {
+		return
+	}
+	go func() {
+		interval := staleRetryInterval
+		for {
+			time.Sleep(interval)
+
+			ctx, cancel := context.WithTimeout(context.Background(), staleLookupTimeout)
+			txts, ttl, err := lookupRecords(ctx, zone, c)
+			cancel()
+			if err == nil {
+				log.Printf("[txtdirect]: refreshed stale records for %s", zone)
+				cache.set(zone, txts, ttl)
+				return
+			}
+			if IsNotFound(err) {
+				cache.setNegative(zone, &LookupError{zone, err}, ttl)
+				return
+			}
+			if _, ok := cache.stale(zone); !ok {
+				log.Printf("[txtdirect]: grace window for %s ended, giving up refresh: %s", zone, err)
+				cache.store.stopRefresh(zone)
+				return
+			}
+
+			if interval < staleRetryMaxInterval {
+				interval *= 2
+			}
+		}
+	}()
+}
+
+func newRecordStore(size int, grace time.Duration) *recordStore {
+	return &recordStore{
+		size:    size,
+		grace:   grace,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (s *recordStore) get(zone string, now time.Time) (cacheEntry, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	elem, ok := s.entries[zone]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := *elem.Value.(*cacheEntry)
+	if now.After(entry.expires) {
+		// Keep the records around while they can still be served stale
+		if entry.err != nil || now.After(entry.expires.Add(s.grace)) {
+			s.lru.Remove(elem)
+			delete(s.entries, zone)
+		}
+		return cacheEntry{}, false
+	}
+	s.lru.MoveToFront(elem)
+
+	// Callers are allowed to modify the returned records
+	entry.txts = append([]string{}, entry.txts...)
+	return entry, true
+}
+
+func (s *recordStore) stale(zone string, now time.Time) (cacheEntry, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	elem, ok := s.entries[zone]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := *elem.Value.(*cacheEntry)
+	if entry.err != nil || !now.After(entry.expires) || now.After(entry.expires.Add(s.grace)) {
+		return cacheEntry{}, false
+	}
+
+	entry.txts = append([]string{}, entry.txts...)
+	return entry, true
+}
+
+// startRefresh marks the zone as being refreshed and reports whether
+// the caller should start the refresh
+func (s *recordStore) startRefresh(zone string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	elem, ok := s.entries[zone]
+	if !ok {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.refreshing {
+		return false
+	}
+	entry.refreshing = true
+	return true
+}
+
+func (s *recordStore) stopRefresh(zone string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if elem, ok := s.entries[zone]; ok {
+		elem.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+// remove drops the zone's entry, including its stale records
+func (s *recordStore) remove(zone string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if elem, ok := s.entries[zone]; ok {
+		s.lru.Remove(elem)
+		delete(s.entries, zone)
+	}
+}
+
+func (s *recordStore) set(zone string, txts []string, err error, expires time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry := &cacheEntry{
+		zone:    zone,
+		txts:    append([]string{}, txts...),
+		err:     err,
+		expires: expires,
+	}
+	if elem, ok := s.entries[zone]; ok {
+		elem.Value = entry
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.entries[zone] = s.lru.PushFront(entry)
+
+	for s.lru.Len() > s.size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).zone)
+	}
+}
+
+// ParseRecordCache parses the txtdirect config for the record cache
+func (cache *RecordCache) ParseRecordCache(c *caddy.Controller) error {
+	switch c.Val() {
+	case "size":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value < 1 {
+			return c.ArgErr()
+		}
+		cache.Size = value
+
+	case "ttl", "maxttl", "negativettl", "grace":
+		option := c.Val()
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := time.ParseDuration(args[0])
+		if err != nil || value <= 0 {
+			return c.ArgErr()
+		}
+		switch option {
+		case "ttl":
+			cache.TTL = value
+		case "maxttl":
+			cache.MaxTTL = value
+		case "negativettl":
+			cache.NegativeTTL = value
+		case "grace":
+			cache.Grace = value
+		}
+
+	default:
+		return c.ArgErr() // unhandled option for record cache
+	}
+	return nil
+}
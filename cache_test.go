@@ -0,0 +1,168 @@
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRecordStore(t *testing.T) {
+	s := newRecordStore(2, 0)
+	now := time.Now()
+
+	s.set("_redirect.a.test.", []string{"a"}, nil, now.Add(time.Minute))
+	s.set("_redirect.b.test.", []string{"b"}, nil, now.Add(time.Minute))
+	// Touch a so b becomes the least recently used zone
+	if _, ok := s.get("_redirect.a.test.", now); !ok {
+		t.Fatalf("Expected _redirect.a.test. to be cached")
+	}
+	s.set("_redirect.c.test.", []string{"c"}, nil, now.Add(time.Minute))
+
+	if _, ok := s.get("_redirect.b.test.", now); ok {
+		t.Errorf("Expected _redirect.b.test. to be evicted")
+	}
+	for _, zone := range []string{"_redirect.a.test.", "_redirect.c.test."} {
+		if _, ok := s.get(zone, now); !ok {
+			t.Errorf("Expected %s to be cached", zone)
+		}
+	}
+
+	if _, ok := s.get("_redirect.a.test.", now.Add(2*time.Minute)); ok {
+		t.Errorf("Expected _redirect.a.test. to be expired")
+	}
+	if len(s.entries) != 1 || s.lru.Len() != 1 {
+		t.Errorf("Expected expired entries to be removed, got %d entries", len(s.entries))
+	}
+
+	entry, _ := s.get("_redirect.c.test.", now)
+	entry.txts[0] = "modified"
+	if entry, _ := s.get("_redirect.c.test.", now); entry.txts[0] != "c" {
+		t.Errorf("Expected cached records to be immutable, got %s", entry.txts[0])
+	}
+}
+
+func TestRecordCache(t *testing.T) {
+	cache := RecordCache{
+		Enable: true,
+		MaxTTL: 2 * time.Minute,
+	}
+	cache.SetDefaults()
+
+	cache.set("_redirect.ttl.test.", []string{"v=txtv0"}, noTTL)
+	cache.set("_redirect.maxttl.test.", []string{"v=txtv0"}, time.Hour)
+	cache.setNegative("_redirect.nx.test.", fmt.Errorf("no such host"), noTTL)
+
+	tests := []struct {
+		zone string
+		ttl  time.Duration
+	}{
+		{"_redirect.ttl.test.", DefaultRecordCacheTTL},
+		{"_redirect.maxttl.test.", 2 * time.Minute},
+		{"_redirect.nx.test.", DefaultNegativeTTL},
+	}
+	for _, test := range tests {
+		entry, ok := cache.get(test.zone)
+		if !ok {
+			t.Errorf("Expected %s to be cached", test.zone)
+			continue
+		}
+		if ttl := time.Until(entry.expires); ttl > test.ttl || ttl < test.ttl-time.Second {
+			t.Errorf("Expected %s to be cached for %s, got %s", test.zone, test.ttl, ttl)
+		}
+	}
+
+	// A TTL of zero means the records mustn't be cached
+	cache.set("_redirect.zero.test.", []string{"v=txtv0"}, time.Minute)
+	cache.set("_redirect.zero.test.", []string{"v=txtv0"}, 0)
+	cache.setNegative("_redirect.nxzero.test.", fmt.Errorf("no such host"), 0)
+	for _, zone := range []string{"_redirect.zero.test.", "_redirect.nxzero.test."} {
+		if _, ok := cache.get(zone); ok {
+			t.Errorf("Expected %s with a TTL of zero to not be cached", zone)
+		}
+	}
+
+	disabled := RecordCache{}
+	disabled.set("_redirect.disabled.test.", []string{"v=txtv0"}, noTTL)
+	if _, ok := disabled.get("_redirect.disabled.test."); ok {
+		t.Errorf("Expected disabled cache to not store records")
+	}
+}
+
+func Test_queryCache(t *testing.T) {
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Cache:    RecordCache{Enable: true},
+	}
+	c.Cache.SetDefaults()
+
+	zone := "_redirect.about.test."
+	resp, err := query(zone, context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != txts[zone] {
+		t.Fatalf("Expected %s, got %s", txts[zone], resp[0])
+	}
+
+	entry, ok := c.Cache.get(zone)
+	if !ok {
+		t.Fatalf("Expected %s to be cached after the lookup", zone)
+	}
+	// The testing DNS server answers with a TTL of 60 seconds
+	if ttl := time.Until(entry.expires); ttl > time.Minute || ttl < 59*time.Second {
+		t.Errorf("Expected record to be cached for the record's TTL, got %s", ttl)
+	}
+
+	// Cached records are returned without asking the resolver
+	c.Cache.set(zone, []string{"v=txtv0;to=https://cached.test"}, noTTL)
+	c.Resolver = "127.0.0.1:1"
+	resp, err = query(zone, context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != "v=txtv0;to=https://cached.test" {
+		t.Errorf("Expected cached record, got %s", resp[0])
+	}
+}
+
+func Test_queryStale(t *testing.T) {
+	c := Config{
+		// Nothing listens on this port so every lookup fails
+		Resolver: "127.0.0.1:1",
+		Cache: RecordCache{
+			Enable: true,
+			Grace:  time.Minute,
+		},
+	}
+	c.Cache.SetDefaults()
+
+	now := time.Now()
+	c.Cache.store.set("_redirect.stale.test.", []string{"v=txtv0;to=https://stale.test"}, nil, now.Add(-time.Second))
+	c.Cache.store.set("_redirect.expired.test.", []string{"v=txtv0;to=https://expired.test"}, nil, now.Add(-2*time.Minute))
+	c.Cache.store.set("_redirect.nx.test.", nil, fmt.Errorf("no such host"), now.Add(-time.Second))
+
+	resp, err := query("_redirect.stale.test", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Expected stale record to be served, got error: %s", err)
+	}
+	if resp[0] != "v=txtv0;to=https://stale.test" {
+		t.Errorf("Expected stale record, got %s", resp[0])
+	}
+	if entry, ok := c.Cache.stale("_redirect.stale.test."); !ok || !entry.refreshing {
+		t.Errorf("Expected stale zone to be refreshed in the background")
+	}
+
+	// While the zone is being refreshed the stale record is served right away
+	resp, err = query("_redirect.stale.test", context.Background(), c)
+	if err != nil || resp[0] != "v=txtv0;to=https://stale.test" {
+		t.Errorf("Expected stale record while refreshing, got %v, %v", resp, err)
+	}
+
+	for _, zone := range []string{"_redirect.expired.test", "_redirect.nx.test"} {
+		if _, err := query(zone, context.Background(), c); err == nil {
+			t.Errorf("Expected error for %s outside of the grace window", zone)
+		}
+	}
+}
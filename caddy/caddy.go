@@ -14,6 +14,7 @@ limitations under the License.
 package caddy
 
 import (
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -39,6 +40,14 @@ func parse(c *caddy.Controller) (txtdirect.Config, error) {
 	var enable []string
 	var redirect string
 	var resolver string
+	var dns txtdirect.DNS
+	var source txtdirect.RecordSource
+	var wildcard string
+	var baseZone string
+	var path txtdirect.Path
+	var preview txtdirect.Preview
+	var dnssec string
+	var cache txtdirect.RecordCache
 	var gomods txtdirect.Gomods
 	var prometheus txtdirect.Prometheus
 	logfile := "stdout"
@@ -75,10 +84,81 @@ func parse(c *caddy.Controller) (txtdirect.Config, error) {
 
 		case "resolver":
 			resolverAddr := c.RemainingArgs()
-			if len(resolverAddr) != 1 {
+			if len(resolverAddr) == 0 {
 				return txtdirect.Config{}, c.ArgErr()
 			}
 			resolver = resolverAddr[0]
+			if len(resolverAddr) > 1 {
+				dns.Upstreams = resolverAddr
+			}
+			if !c.NextArg() {
+				continue
+			}
+			if c.Val() != "{" {
+				return txtdirect.Config{}, c.ArgErr()
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				err := dns.ParseDNS(c)
+				if err != nil {
+					return txtdirect.Config{}, err
+				}
+			}
+
+		case "source":
+			var err error
+			source, err = txtdirect.ParseSource(c)
+			if err != nil {
+				return txtdirect.Config{}, err
+			}
+
+		case "wildcard":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return txtdirect.Config{}, c.ArgErr()
+			}
+			switch args[0] {
+			case txtdirect.WildcardSingle, txtdirect.WildcardReplace, txtdirect.WildcardCollapse:
+				wildcard = args[0]
+			default:
+				return txtdirect.Config{}, c.ArgErr()
+			}
+
+		case "basezone":
+			args := c.RemainingArgs()
+			if len(args) != 1 || !validLabel(args[0]) {
+				return txtdirect.Config{}, c.ArgErr()
+			}
+			baseZone = args[0]
+
+		case "path":
+			c.NextArg()
+			if c.Val() != "{" {
+				return txtdirect.Config{}, c.ArgErr()
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				err := path.ParsePath(c)
+				if err != nil {
+					return txtdirect.Config{}, err
+				}
+			}
+
+		case "dnssec":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return txtdirect.Config{}, c.ArgErr()
+			}
+			switch args[0] {
+			case txtdirect.DNSSECOff, txtdirect.DNSSECPrefer, txtdirect.DNSSECRequire:
+				dnssec = args[0]
+			default:
+				return txtdirect.Config{}, c.ArgErr()
+			}
 
 		case "logfile":
 			// Set stdout as the default value
@@ -86,6 +166,39 @@ func parse(c *caddy.Controller) (txtdirect.Config, error) {
 				logfile = c.Val()
 			}
 			parseLogfile(logfile)
+
+		case "cache":
+			cache.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				err := cache.ParseRecordCache(c)
+				if err != nil {
+					return txtdirect.Config{}, err
+				}
+			}
+
+		case "preview":
+			preview.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				err := preview.ParsePreview(c)
+				if err != nil {
+					return txtdirect.Config{}, err
+				}
+			}
+
 		case "gomods":
 			gomods.Enable = true
 			c.NextArg()
@@ -123,11 +236,38 @@ func parse(c *caddy.Controller) (txtdirect.Config, error) {
 		}
 	}
 
+	// The system resolver doesn't report whether the answer is authenticated
+	if dnssec == txtdirect.DNSSECRequire && resolver == "" {
+		return txtdirect.Config{}, c.Err("dnssec require needs a custom resolver")
+	}
+	// Records from other sources aren't looked up using DNS
+	if source != nil {
+		switch dnssec {
+		case txtdirect.DNSSECRequire:
+			return txtdirect.Config{}, c.Err("dnssec require can't be used with a record source other than dns")
+		case txtdirect.DNSSECPrefer:
+			log.Printf("[txtdirect]: dnssec prefer has no effect on records from the %T record source", source)
+		}
+	}
+
 	// If nothing is specified, enable everything
 	if enable == nil {
 		enable = allOptions
 	}
 
+	if cache.Enable {
+		cache.SetDefaults()
+	}
+	if preview.Enable {
+		preview.SetDefaults()
+		// Previews are never honoured without an allowlist
+		if len(preview.Allow) == 0 {
+			return txtdirect.Config{}, c.Err("preview needs at least one allowed network")
+		}
+		if !validLabel(preview.Zone) {
+			return txtdirect.Config{}, c.Err("invalid preview zone " + preview.Zone)
+		}
+	}
 	if gomods.Enable == true {
 		gomods.SetDefaults()
 	}
@@ -139,7 +279,15 @@ func parse(c *caddy.Controller) (txtdirect.Config, error) {
 		Enable:     enable,
 		Redirect:   redirect,
 		Resolver:   resolver,
+		DNS:        dns,
+		Source:     source,
+		Wildcard:   wildcard,
+		BaseZone:   baseZone,
+		Path:       path,
+		Preview:    preview,
+		DNSSEC:     dnssec,
 		LogOutput:  logfile,
+		Cache:      cache,
 		Gomods:     gomods,
 		Prometheus: prometheus,
 	}
@@ -159,6 +307,11 @@ func setup(c *caddy.Controller) error {
 		config.Prometheus.Setup(c)
 	}
 
+	// Stop watching the record source's files when the server stops
+	if closer, ok := config.Source.(io.Closer); ok {
+		c.OnShutdown(closer.Close)
+	}
+
 	// Add handler to Caddy
 	cfg := httpserver.GetConfig(c)
 	mid := func(next httpserver.Handler) httpserver.Handler {
@@ -172,6 +325,19 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
+// validLabel checks if the given string can be used as a single DNS label
+func validLabel(label string) bool {
+	if label == "" || len(label) > 63 {
+		return false
+	}
+	for _, r := range label {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
 func removeArrayFromArray(array, toBeRemoved []string) []string {
 	tmp := make([]string, len(array))
 	copy(tmp, array)
@@ -195,10 +361,10 @@ type Redirect struct {
 
 func (rd Redirect) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	if err := txtdirect.Redirect(w, r, rd.Config); err != nil {
-		if err.Error() == "option disabled" {
+		if txtdirect.IsTypeDisabled(err) {
 			return rd.Next.ServeHTTP(w, r)
 		}
-		return http.StatusInternalServerError, err
+		return txtdirect.StatusCode(err), err
 	}
 
 	// Count total redirects if prometheus is enabled
@@ -16,9 +16,11 @@ package caddy
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/spf13/afero"
 
@@ -354,6 +356,509 @@ func TestParse(t *testing.T) {
 				LogOutput: "stdout",
 			},
 		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver https://doh.example/dns-query
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				Resolver:  "https://doh.example/dns-query",
+				LogOutput: "stdout",
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver tls://9.9.9.9:853 {
+					servername dns.quad9.net
+					pin sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+				}
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				Resolver:  "tls://9.9.9.9:853",
+				LogOutput: "stdout",
+				DNS: txtdirect.DNS{
+					ServerName: "dns.quad9.net",
+					Pins:       []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver tls://9.9.9.9:853 {
+					pin 47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver tls://9.9.9.9:853 {
+					sni dns.quad9.net
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1 tls://9.9.9.9 https://doh.example/dns-query {
+					policy race
+					timeout 500ms
+					maxfails 5
+					downtime 1m
+				}
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				Resolver:  "127.0.0.1",
+				LogOutput: "stdout",
+				DNS: txtdirect.DNS{
+					Upstreams: []string{"127.0.0.1", "tls://9.9.9.9", "https://doh.example/dns-query"},
+					Policy:    "race",
+					Timeout:   500 * time.Millisecond,
+					MaxFails:  5,
+					Downtime:  time.Minute,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1 {
+					lookuptimeout 5s
+					retries 2
+					backoff 50ms
+					tcp
+					bufsize 1232
+					cnamedepth 4
+				}
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				Resolver:  "127.0.0.1",
+				LogOutput: "stdout",
+				DNS: txtdirect.DNS{
+					LookupTimeout: 5 * time.Second,
+					Retries:       2,
+					Backoff:       50 * time.Millisecond,
+					TCP:           true,
+					BufSize:       1232,
+					CNAMEDepth:    4,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1 {
+					bufsize 100
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1 127.0.0.2 {
+					policy fastest
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1 127.0.0.2 {
+					maxfails 0
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				source http https://records.example.com/txt
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				LogOutput: "stdout",
+				Source:    &txtdirect.HTTPSource{URL: "https://records.example.com/txt"},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				source dns
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				LogOutput: "stdout",
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				source file /nonexistent/records.yml
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				source zone /nonexistent/db.example.com example.com
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				basezone _redirect-staging
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				LogOutput: "stdout",
+				BaseZone:  "_redirect-staging",
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				basezone _links.example
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host path
+				path {
+					chaindepth 3
+					prefix
+				}
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host", "path"},
+				LogOutput: "stdout",
+				Path:      txtdirect.Path{ChainDepth: 3, Prefix: true},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host path
+				path {
+					chaindepth 0
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host path
+				path {
+					trailingslash redirect-strip
+					caseinsensitive
+					mergeslashes
+				}
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host", "path"},
+				LogOutput: "stdout",
+				Path: txtdirect.Path{
+					TrailingSlash:   "redirect-strip",
+					CaseInsensitive: true,
+					MergeSlashes:    true,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host path
+				path {
+					trailingslash add
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				preview {
+					cookie txtdirect_preview
+					zone _links-preview
+					allow 10.0.0.0/8 2001:db8::1
+				}
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				LogOutput: "stdout",
+				Preview: txtdirect.Preview{
+					Enable: true,
+					Header: "X-Txtdirect-Preview",
+					Cookie: "txtdirect_preview",
+					Zone:   "_links-preview",
+					Allow: []*net.IPNet{
+						{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+						{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(128, 128)},
+					},
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				preview
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				preview {
+					allow 10.0.0.0/33
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				wildcard collapse
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				LogOutput: "stdout",
+				Wildcard:  "collapse",
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				wildcard recursive
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				source etcd
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1
+				dnssec require
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				Resolver:  "127.0.0.1",
+				LogOutput: "stdout",
+				DNSSEC:    "require",
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				dnssec prefer
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				LogOutput: "stdout",
+				DNSSEC:    "prefer",
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				dnssec require
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1
+				source http https://records.example.com/txt
+				dnssec require
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1
+				dnssec always
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1
+				cache
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				Resolver:  "127.0.0.1",
+				LogOutput: "stdout",
+				Cache: txtdirect.RecordCache{
+					Enable:      true,
+					Size:        1024,
+					TTL:         time.Minute,
+					MaxTTL:      time.Hour,
+					NegativeTTL: 30 * time.Second,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				cache {
+					size 10
+					ttl 5m
+					maxttl 10m
+					negativettl 1m
+					grace 1h
+				}
+			}
+			`,
+			false,
+			txtdirect.Config{
+				Enable:    []string{"host"},
+				LogOutput: "stdout",
+				Cache: txtdirect.RecordCache{
+					Enable:      true,
+					Size:        10,
+					TTL:         5 * time.Minute,
+					MaxTTL:      10 * time.Minute,
+					NegativeTTL: time.Minute,
+					Grace:       time.Hour,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				cache {
+					size zero
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				cache {
+					ttl 5
+				}
+			}
+			`,
+			true,
+			txtdirect.Config{},
+		},
 	}
 
 	for i, test := range tests {
@@ -394,6 +899,51 @@ func TestParse(t *testing.T) {
 			}
 		}
 
+		if test.expected.Cache.Enable {
+			got, want := conf.Cache, test.expected.Cache
+			if got.Size != want.Size || got.TTL != want.TTL || got.MaxTTL != want.MaxTTL || got.NegativeTTL != want.NegativeTTL || got.Grace != want.Grace {
+				t.Errorf("Test %d: Expected %+v for cache config got %+v", i, want, got)
+			}
+		}
+
+		if test.expected.DNS.ServerName != conf.DNS.ServerName || !identical(conf.DNS.Pins, test.expected.DNS.Pins) ||
+			!identical(conf.DNS.Upstreams, test.expected.DNS.Upstreams) || test.expected.DNS.Policy != conf.DNS.Policy ||
+			test.expected.DNS.Timeout != conf.DNS.Timeout || test.expected.DNS.MaxFails != conf.DNS.MaxFails ||
+			test.expected.DNS.Downtime != conf.DNS.Downtime || test.expected.DNS.LookupTimeout != conf.DNS.LookupTimeout ||
+			test.expected.DNS.Retries != conf.DNS.Retries || test.expected.DNS.Backoff != conf.DNS.Backoff ||
+			test.expected.DNS.TCP != conf.DNS.TCP || test.expected.DNS.BufSize != conf.DNS.BufSize ||
+			test.expected.DNS.CNAMEDepth != conf.DNS.CNAMEDepth {
+			t.Errorf("Test %d: Expected %+v for resolver options got %+v", i, test.expected.DNS, conf.DNS)
+		}
+
+		if fmt.Sprintf("%T", test.expected.Source) != fmt.Sprintf("%T", conf.Source) {
+			t.Errorf("Test %d: Expected %T record source, got %T", i, test.expected.Source, conf.Source)
+		} else if want, ok := test.expected.Source.(*txtdirect.HTTPSource); ok && want.URL != conf.Source.(*txtdirect.HTTPSource).URL {
+			t.Errorf("Test %d: Expected records endpoint %s, got %s", i, want.URL, conf.Source.(*txtdirect.HTTPSource).URL)
+		}
+
+		if test.expected.Preview.Enable {
+			got, want := conf.Preview, test.expected.Preview
+			if got.Header != want.Header || got.Cookie != want.Cookie || got.Zone != want.Zone || fmt.Sprint(got.Allow) != fmt.Sprint(want.Allow) {
+				t.Errorf("Test %d: Expected %+v for preview config got %+v", i, want, got)
+			}
+		}
+
+		if test.expected.BaseZone != conf.BaseZone {
+			t.Errorf("Test %d: Expected base zone to be %s, but got %s", i, test.expected.BaseZone, conf.BaseZone)
+		}
+		if test.expected.Path != conf.Path {
+			t.Errorf("Test %d: Expected path config to be %+v, but got %+v", i, test.expected.Path, conf.Path)
+		}
+
+		if test.expected.Wildcard != conf.Wildcard {
+			t.Errorf("Test %d: Expected wildcard mode to be %s, but got %s", i, test.expected.Wildcard, conf.Wildcard)
+		}
+
+		if test.expected.DNSSEC != conf.DNSSEC {
+			t.Errorf("Test %d: Expected dnssec to be %s, but got %s", i, test.expected.DNSSEC, conf.DNSSEC)
+		}
+
 		if test.expected.Resolver != conf.Resolver {
 			t.Errorf("Expected resolver to be %s, but got %s", test.expected.Resolver, conf.Resolver)
 		}
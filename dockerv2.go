@@ -1,7 +1,6 @@
 package txtdirect
 
 import (
-	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -36,12 +35,12 @@ func redirectDockerv2(w http.ResponseWriter, r *http.Request, rec record) error
 		if err != nil {
 			return err
 		}
-		w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+		cachePermanent(w)
 		w.Header().Add("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
 		http.Redirect(w, r, uri, http.StatusMovedPermanently)
 		return nil
 	}
-	w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+	cachePermanent(w)
 	w.Header().Add("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
 	http.Redirect(w, r, rec.To, http.StatusMovedPermanently)
 	return nil
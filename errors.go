@@ -0,0 +1,211 @@
+/*
+Copyright 2017 - The TXTdirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNotFound means the zone doesn't have any TXT records.
+	// Record sources can return it instead of NotFoundError.
+	ErrNotFound = errors.New(errNoSuchHost)
+	// ErrNoRecord means none of the zone's TXT records is an
+	// enabled txtdirect record
+	ErrNoRecord = errors.New("could not find an enabled txtdirect record")
+	// ErrTypeDisabled means the record's type isn't enabled in the config
+	ErrTypeDisabled = errors.New("type is not enabled in configuration")
+	// ErrTypeUnsupported means the record's type can't be handled
+	ErrTypeUnsupported = errors.New("type is not supported")
+	// ErrPathNoMatch means the record's re= doesn't match the path
+	ErrPathNoMatch = errors.New("custom regex doesn't match the path")
+	// ErrChainLoop means a path record delegates back to a zone
+	// that's already in the chain
+	ErrChainLoop = errors.New("loop detected")
+	// ErrChainDepth means the path records delegate more times than
+	// the configured limit
+	ErrChainDepth = errors.New("chain is too long")
+)
+
+// LookupError is returned when the records of a zone can't be found
+type LookupError struct {
+	Zone string
+	Err  error
+}
+
+func (e *LookupError) Error() string {
+	return fmt.Sprintf("could not get TXT record: %s", e.Err)
+}
+
+func (e *LookupError) Unwrap() error { return e.Err }
+
+// RecordError is returned when a TXT record is invalid. Field is empty
+// when the error isn't about a single field. Offset is the position
+// of the character that failed, counted in characters from the start
+// of the record, or -1 when it's unknown.
+type RecordError struct {
+	Field  string
+	Offset int
+	Reason string
+}
+
+func (e *RecordError) Error() string {
+	switch {
+	case e.Field == "" && e.Offset < 0:
+		return fmt.Sprintf("invalid record: %s", e.Reason)
+	case e.Field == "":
+		return fmt.Sprintf("invalid record at offset %d: %s", e.Offset, e.Reason)
+	case e.Offset < 0:
+		return fmt.Sprintf("invalid %s= field: %s", e.Field, e.Reason)
+	}
+	return fmt.Sprintf("invalid %s= field at offset %d: %s", e.Field, e.Offset, e.Reason)
+}
+
+// TypeError is returned when a record's type can't be served, Err is
+// either ErrTypeDisabled or ErrTypeUnsupported
+type TypeError struct {
+	Type string
+	Err  error
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("%s %s", e.Type, e.Err)
+}
+
+func (e *TypeError) Unwrap() error { return e.Err }
+
+// ChainError is returned when path records can't be chained, Err is
+// either ErrChainLoop or ErrChainDepth. Chain lists the zones of the
+// path records that were followed.
+type ChainError struct {
+	Chain []string
+	Err   error
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("path %s: %s", e.Err, strings.Join(e.Chain, " -> "))
+}
+
+func (e *ChainError) Unwrap() error { return e.Err }
+
+// UpstreamError is returned when an upstream resolver fails to answer
+type UpstreamError struct {
+	Upstream string
+	Err      error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("resolver %s failed: %s", e.Upstream, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// DNSSECError is returned when an answer isn't authenticated
+// while DNSSEC is required
+type DNSSECError struct {
+	Zone   string
+	Reason string
+}
+
+func (e *DNSSECError) Error() string {
+	return fmt.Sprintf("DNSSEC validation failed for %s: %s", e.Zone, e.Reason)
+}
+
+// IsNotFound checks if the error means that the zone doesn't exist
+// or doesn't have any TXT records
+func IsNotFound(err error) bool {
+	return findError(err, func(err error) bool {
+		if dnsErr, ok := err.(*net.DNSError); ok {
+			return dnsErr.Err == errNoSuchHost
+		}
+		return err == ErrNotFound
+	})
+}
+
+// IsTypeDisabled checks if the error means that the record's type
+// isn't enabled in the config
+func IsTypeDisabled(err error) bool {
+	return findError(err, func(err error) bool {
+		return err == ErrTypeDisabled
+	})
+}
+
+// isDNSSECError checks if the given error is a DNSSEC validation failure
+func isDNSSECError(err error) bool {
+	return findError(err, func(err error) bool {
+		_, ok := err.(*DNSSECError)
+		return ok
+	})
+}
+
+// StatusCode returns the HTTP status code for the error returned
+// while redirecting a request
+func StatusCode(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case IsNotFound(err), err == ErrNoRecord, IsTypeDisabled(err):
+		return http.StatusNotFound
+	case findError(err, func(err error) bool { return err == ErrTypeUnsupported }):
+		return http.StatusNotImplemented
+	case isDNSSECError(err):
+		return http.StatusBadGateway
+	case findError(err, isTimeout):
+		return http.StatusGatewayTimeout
+	case findError(err, isUpstreamError):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// isLookupFailure checks if the error means that the records couldn't
+// be looked up, rather than that they don't exist
+func isLookupFailure(err error) bool {
+	if err == nil || IsNotFound(err) {
+		return false
+	}
+	return isDNSSECError(err) || findError(err, isTimeout) || findError(err, isUpstreamError)
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func isUpstreamError(err error) bool {
+	switch err.(type) {
+	case *UpstreamError, *net.DNSError:
+		return true
+	}
+	return false
+}
+
+// findError checks the error and the errors it wraps with match
+func findError(err error, match func(error) bool) bool {
+	for err != nil {
+		if match(err) {
+			return true
+		}
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = wrapper.Unwrap()
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, http.StatusOK},
+		{NotFoundError("_redirect.example.com."), http.StatusNotFound},
+		{&LookupError{"_redirect.example.com.", ErrNotFound}, http.StatusNotFound},
+		{ErrNoRecord, http.StatusNotFound},
+		{&TypeError{"path", ErrTypeDisabled}, http.StatusNotFound},
+		{&TypeError{"foo", ErrTypeUnsupported}, http.StatusNotImplemented},
+		{&LookupError{"_redirect.example.com.", &DNSSECError{"_redirect.example.com.", "answer isn't authenticated"}}, http.StatusBadGateway},
+		{&LookupError{"_redirect.example.com.", &UpstreamError{"127.0.0.1:53", fmt.Errorf("server misbehaving: REFUSED")}}, http.StatusBadGateway},
+		{&UpstreamError{"127.0.0.1:53", context.DeadlineExceeded}, http.StatusGatewayTimeout},
+		{&RecordError{"code", 8, "could not parse status code"}, http.StatusInternalServerError},
+		{fmt.Errorf("no such host"), http.StatusInternalServerError},
+	}
+	for i, test := range tests {
+		if code := StatusCode(test.err); code != test.code {
+			t.Errorf("Test %d: expected status %d for %v, got %d", i, test.code, test.err, code)
+		}
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	tests := []struct {
+		err      *RecordError
+		expected string
+	}{
+		{&RecordError{"code", 8, "bad code"}, "invalid code= field at offset 8: bad code"},
+		{&RecordError{"", 8, "empty key"}, "invalid record at offset 8: empty key"},
+		{&RecordError{"to", -1, "to= field is required"}, "invalid to= field: to= field is required"},
+		{&RecordError{"", -1, "too long"}, "invalid record: too long"},
+	}
+	for _, test := range tests {
+		if test.err.Error() != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, test.err.Error())
+		}
+	}
+}
+
+func TestParseErrorTypes(t *testing.T) {
+	c := Config{Enable: []string{"host"}}
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+
+	rec := record{}
+	err := rec.Parse("v=txtv0;to=https://example.com/;type=path", req, c)
+	if !IsTypeDisabled(err) {
+		t.Errorf("Expected a disabled type error, got %v", err)
+	}
+
+	rec = record{}
+	err = rec.Parse("v=txtv0;to=https://example.com/;code=abc", req, c)
+	recErr, ok := err.(*RecordError)
+	if !ok || recErr.Field != "code" || recErr.Offset != 32 {
+		t.Errorf("Expected an invalid code= field at offset 32, got %#v", err)
+	}
+}
+
+func TestRedirectNotFoundFallback(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "www"},
+		Source: &FileSource{records: map[string][]string{}},
+	}
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	resp := httptest.NewRecorder()
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.Code != http.StatusMovedPermanently || resp.Header().Get("Location") != "https://www.example.com" {
+		t.Errorf("Expected a redirect to www, got %d %s", resp.Code, resp.Header().Get("Location"))
+	}
+
+	c.Source = &FileSource{records: map[string][]string{
+		"_redirect.example.com.": {"v=txtv0;to=https://example.com/;type=path"},
+	}}
+	err := Redirect(httptest.NewRecorder(), req, c)
+	if !IsTypeDisabled(err) {
+		t.Errorf("Expected a disabled type error, got %v", err)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	if !IsNotFound(&net.DNSError{Err: "no such host", Name: "example.com."}) {
+		t.Errorf("Expected the system resolver's error to mean not found")
+	}
+	if IsNotFound(&UpstreamError{"127.0.0.1:53", fmt.Errorf("no such host")}) {
+		t.Errorf("Expected the upstream failure not to mean not found")
+	}
+}
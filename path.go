@@ -5,77 +5,335 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
+
+	"github.com/mholt/caddy"
 )
 
 var PathRegex = regexp.MustCompile("\\/([A-Za-z0-9-._~!$'()*+,;=:@]+)")
 var FromRegex = regexp.MustCompile("\\/\\$(\\d+)")
-var GroupRegex = regexp.MustCompile("P<[a-zA-Z]+[a-zA-Z0-9]*>")
-var GroupOrderRegex = regexp.MustCompile("P<([a-zA-Z]+[a-zA-Z0-9]*)>")
 
-// zoneFromPath generates a DNS zone with the given host and path
+// Path encodings of path records
+const (
+	PathEncodingHex = "hex"
+)
+
+// maxLabelLength is the maximum length of a DNS label
+const maxLabelLength = 63
+
+// maxNameLength is the maximum length of a DNS name without the
+// trailing dot
+const maxNameLength = 253
+
+// regexCacheSize is the number of compiled record regexes that are kept
+const regexCacheSize = 1024
+
+var regexCache = struct {
+	sync.Mutex
+	regexes map[string]*regexp.Regexp
+}{regexes: make(map[string]*regexp.Regexp)}
+
+// DefaultPathChainDepth is the number of path records that can
+// delegate a request to another path record
+const DefaultPathChainDepth = 5
+
+// Trailing slash policies of path records
+const (
+	SlashIgnore        = "ignore"
+	SlashRedirectAdd   = "redirect-add"
+	SlashRedirectStrip = "redirect-strip"
+)
+
+var DuplicateSlashesRegex = regexp.MustCompile("//+")
+
+// Path contains the options used for path records
+type Path struct {
+	ChainDepth int
+	// Prefix enables matching the longest prefix of the path
+	// that has a record
+	Prefix bool
+	// TrailingSlash, CaseInsensitive and MergeSlashes are the
+	// defaults for the records' slash=, case= and slashes= fields
+	TrailingSlash   string
+	CaseInsensitive bool
+	MergeSlashes    bool
+}
+
+// pathPolicy is how a path record treats the request's path
+type pathPolicy struct {
+	trailingSlash   string
+	caseInsensitive bool
+	mergeSlashes    bool
+}
+
+// policy returns the path policy of the record, the record's
+// fields override the config
+func (p Path) policy(rec record) pathPolicy {
+	policy := pathPolicy{p.TrailingSlash, p.CaseInsensitive, p.MergeSlashes}
+	if rec.Slash != "" {
+		policy.trailingSlash = rec.Slash
+	}
+	if rec.Case != "" {
+		policy.caseInsensitive = rec.Case == "insensitive"
+	}
+	if rec.Slashes != "" {
+		policy.mergeSlashes = rec.Slashes == "merge"
+	}
+	return policy
+}
+
+// canonical returns the canonical form of the escaped path that the
+// request is redirected to when it differs, and the path used to find
+// the records
+func (p pathPolicy) canonical(path string) (string, string) {
+	if p.mergeSlashes {
+		path = DuplicateSlashesRegex.ReplaceAllString(path, "/")
+	}
+	if path != "/" {
+		switch p.trailingSlash {
+		case SlashRedirectAdd:
+			if !strings.HasSuffix(path, "/") {
+				path += "/"
+			}
+		case SlashRedirectStrip:
+			path = "/" + strings.Trim(path, "/")
+		}
+	}
+
+	match := path
+	if p.trailingSlash == SlashIgnore {
+		match = "/" + strings.Trim(match, "/")
+	}
+	if p.caseInsensitive {
+		match = strings.ToLower(match)
+	}
+	return path, match
+}
+
+// redirectPath redirects the request to the canonical form of its path
+func redirectPath(w http.ResponseWriter, r *http.Request, host, path string, c Config) {
+	// "//host" would be taken as another host by the clients
+	path = "/" + strings.TrimLeft(path, "/")
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, path)
+	cachePermanent(w)
+	w.Header().Add("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
+	http.Redirect(w, r, path, http.StatusMovedPermanently)
+	if c.Prometheus.Enable {
+		RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusMovedPermanently)).Add(1)
+	}
+}
+
+// chainDepth returns the chain depth limit or the default
+func (p Path) chainDepth() int {
+	if p.ChainDepth == 0 {
+		return DefaultPathChainDepth
+	}
+	return p.ChainDepth
+}
+
+// ParsePath parses the txtdirect config for path records
+func (p *Path) ParsePath(c *caddy.Controller) error {
+	switch c.Val() {
+	case "chaindepth":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value < 1 {
+			return c.ArgErr()
+		}
+		p.ChainDepth = value
+
+	case "prefix", "caseinsensitive", "mergeslashes":
+		option := c.Val()
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		switch option {
+		case "prefix":
+			p.Prefix = true
+		case "caseinsensitive":
+			p.CaseInsensitive = true
+		case "mergeslashes":
+			p.MergeSlashes = true
+		}
+
+	case "trailingslash":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case SlashIgnore, SlashRedirectAdd, SlashRedirectStrip:
+			p.TrailingSlash = args[0]
+		default:
+			return c.ArgErr()
+		}
+
+	default:
+		return c.ArgErr() // unhandled option for path records
+	}
+	return nil
+}
+
+// pathMatch is a zone generated from the request's path
+type pathMatch struct {
+	zone string
+	// from is the number of labels generated from each of the
+	// path's segments in the zone's order
+	from      []int
+	pathSlice []string
+	// groups are the named groups of the record's regex
+	groups map[string]string
+	// rest is the part of the path after the prefix
+	rest string
+	// prefixes are the zones of the path's prefixes from the
+	// longest to the shortest, only set in prefix mode
+	prefixes []pathMatch
+	// path is the escaped path the zone was generated from
+	path string
+	// remainder is the escaped part of the path that isn't in
+	// the zone, path records without re=, from= or match= map it
+	// when they delegate the request
+	remainder string
+}
+
+// pathSegment is a part of the path and the labels it's encoded to
+type pathSegment struct {
+	value  string
+	labels []string
+	// rest is the part of the path after the segment
+	rest string
+}
+
+// zoneFromPath generates a DNS zone with the given host and escaped path
 // It will use custom regex to parse the path if it's provided in
 // the given record.
-func zoneFromPath(host string, path string, rec record) (string, int, []string, error) {
-	if strings.ContainsAny(path, ".") {
-		path = strings.Replace(path, ".", "-", -1)
+func zoneFromPath(host string, path string, rec record, c Config) (pathMatch, error) {
+	match, err := mapPath(host, path, rec, c)
+	// Path records found for the zone map the same path
+	match.path = path
+	return match, err
+}
+
+// mapPath maps the escaped path to the zone's labels
+func mapPath(host string, path string, rec record, c Config) (pathMatch, error) {
+	decoded, err := url.PathUnescape(path)
+	if err != nil {
+		decoded = path
+	}
+	// Replacing "." keeps the offsets of matchPath valid in decoded
+	matchPath := decoded
+	if rec.Enc == "" && strings.ContainsAny(matchPath, ".") {
+		matchPath = strings.Replace(matchPath, ".", "-", -1)
 	}
-	pathSubmatchs := PathRegex.FindAllStringSubmatch(path, -1)
-	if rec.Re != "" {
-		CustomRegex, err := regexp.Compile(rec.Re)
+
+	var segments []pathSegment
+	// captures are the glob's wildcards, used as {$N} instead of
+	// the segments
+	var captures []string
+	// remainder is the part of the path after the regex's matches
+	var remainder string
+	switch {
+	case rec.Re != "":
+		re, err := compileRegex(rec.Re)
 		if err != nil {
-			log.Printf("<%s> [txtdirect]: the given regex doesn't work as expected: %s", time.Now().String(), rec.Re)
-		}
-		pathSubmatchs = CustomRegex.FindAllStringSubmatch(path, -1)
-		if GroupRegex.MatchString(rec.Re) {
-			pathSlice := []string{}
-			unordered := make(map[string]string)
-			for _, item := range pathSubmatchs[0] {
-				pathSlice = append(pathSlice, item)
+			return pathMatch{}, &RecordError{"re", -1, err.Error()}
+		}
+		if hasNamedGroups(re) {
+			return zoneFromGroups(host, matchPath, decoded, re, rec, c)
+		}
+		matches := re.FindAllStringSubmatchIndex(matchPath, -1)
+		if matches == nil {
+			log.Printf("[txtdirect]: custom regex doesn't match %s", matchPath)
+			return pathMatch{}, ErrPathNoMatch
+		}
+		// The first group of every match is used, or the whole
+		// match when the regex doesn't have any groups
+		for _, index := range matches {
+			start, end := index[0], index[1]
+			if len(index) > 2 {
+				start, end = index[2], index[3]
 			}
-			order := GroupOrderRegex.FindAllStringSubmatch(rec.Re, -1)
-			for i, group := range order {
-				unordered[group[1]] = pathSlice[i+1]
+			if start >= 0 && end > start {
+				segments = append(segments, newPathSegment(matchPath[start:end], rec))
 			}
-			url := sortMap(unordered)
-			reverse(url)
-			from := len(pathSlice)
-			url = append(url, host)
-			url = append([]string{basezone}, url...)
-			return strings.Join(url, "."), from, pathSlice, nil
+		}
+		remainder = remainderPath(decoded[matches[len(matches)-1][1]:])
+
+	case rec.Match != "":
+		re, err := compileGlob(rec.Match)
+		if err != nil {
+			return pathMatch{}, &RecordError{"match", -1, err.Error()}
+		}
+		// Globs are matched before "." is replaced, so "*.pdf" works
+		match := re.FindStringSubmatch(decoded)
+		if match == nil {
+			log.Printf("[txtdirect]: glob doesn't match %s", decoded)
+			return pathMatch{}, ErrPathNoMatch
+		}
+		captures = match[1:]
+		// "**" can match several segments, each one is a label
+		for _, capture := range captures {
+			for _, segment := range strings.Split(capture, "/") {
+				if rec.Enc == "" {
+					segment = strings.Replace(segment, ".", "-", -1)
+				}
+				if segment != "" {
+					segments = append(segments, newPathSegment(segment, rec))
+				}
+			}
+		}
+
+	case rec.Enc != "":
+		segments = splitPath(path, rec)
+
+	default:
+		for _, index := range PathRegex.FindAllStringSubmatchIndex(matchPath, -1) {
+			segment := matchPath[index[2]:index[3]]
+			segments = append(segments, pathSegment{
+				value:  segment,
+				labels: []string{segment},
+				rest:   strings.TrimPrefix(decoded[index[1]:], "/"),
+			})
 		}
 	}
-	pathSlice := []string{}
-	for _, v := range pathSubmatchs {
-		pathSlice = append(pathSlice, v[1])
+
+	var pathSlice []string
+	for _, segment := range segments {
+		pathSlice = append(pathSlice, segment.value)
 	}
-	if len(pathSlice) < 1 && rec.Re != "" {
-		log.Printf("<%s> [txtdirect]: custom regex doesn't work on %s", time.Now().String(), path)
+	if captures != nil {
+		pathSlice = captures
 	}
-	from := len(pathSlice)
 	if rec.From != "" {
 		fromSubmatch := FromRegex.FindAllStringSubmatch(rec.From, -1)
-		if len(fromSubmatch) != len(pathSlice) {
-			return "", 0, []string{}, fmt.Errorf("length of path doesn't match with length of from= in record")
+		if len(fromSubmatch) != len(segments) {
+			return pathMatch{}, fmt.Errorf("length of path doesn't match with length of from= in record")
 		}
-		fromSlice := make(map[int]string)
+		fromSlice := make(map[int]pathSegment)
 		for k, v := range fromSubmatch {
 			index, _ := strconv.Atoi(v[1])
-			fromSlice[index] = pathSlice[k]
+			fromSlice[index] = segments[k]
 		}
 
 		keys := []int{}
 		for k := range fromSlice {
 			keys = append(keys, k)
 		}
-		if len(keys) != len(pathSlice) {
-			return "", 0, []string{}, fmt.Errorf("length of path doesn't match with length of from= in record")
+		if len(keys) != len(segments) {
+			return pathMatch{}, fmt.Errorf("length of path doesn't match with length of from= in record")
 		}
-		generatedPath := []string{}
+		generatedPath := []pathSegment{}
 
 		sort.Sort(sort.Reverse(sort.IntSlice(keys)))
 
@@ -83,47 +341,384 @@ func zoneFromPath(host string, path string, rec record) (string, int, []string,
 			generatedPath = append(generatedPath, fromSlice[k])
 		}
 
-		url := append(generatedPath, host)
-		url = append([]string{basezone}, url...)
-		return strings.Join(url, "."), from, pathSlice, nil
+		match := newPathMatch(host, generatedPath, c)
+		match.pathSlice = pathSlice
+		return match, nil
+	}
+
+	reverseSegments(segments)
+	match := newPathMatch(host, segments, c)
+	match.remainder = remainder
+	if captures != nil {
+		match.pathSlice = captures
+	}
+	// Only the paths mapped in the default order can be shortened
+	if c.Path.Prefix && rec.Re == "" && rec.Match == "" {
+		for n := len(segments); n > 0; n-- {
+			prefix := newPathMatch(host, segments[len(segments)-n:], c)
+			prefix.rest = segments[len(segments)-n].rest
+			// The segments' rest is only escaped with enc=
+			prefix.remainder = remainderPath(prefix.rest)
+			if rec.Enc != "" && prefix.rest != "" {
+				prefix.remainder = "/" + prefix.rest
+			}
+			match.prefixes = append(match.prefixes, prefix)
+		}
+	}
+	return match, nil
+}
+
+// remainderPath escapes the decoded part of the path that's left
+// after the mapped segments
+func remainderPath(path string) string {
+	path = strings.TrimLeft(path, "/")
+	if path == "" {
+		return ""
 	}
-	ps := pathSlice
-	reverse(pathSlice)
-	url := append(pathSlice, host)
-	url = append([]string{basezone}, url...)
-	return strings.Join(url, "."), from, ps, nil
+	return (&url.URL{Path: "/" + path}).EscapedPath()
 }
 
-// getFinalRecord finds the final TXT record for the given zone.
-// It will try wildcards if the first zone return error
-func getFinalRecord(zone string, from int, ctx context.Context, c Config, r *http.Request, pathSlice []string) (record, error) {
-	txts, err := query(zone, ctx, c)
+// newPathMatch generates the zone from the path's segments, the
+// first segment is the furthest from the host
+func newPathMatch(host string, segments []pathSegment, c Config) pathMatch {
+	url := []string{c.baseZone()}
+	var pathSlice []string
+	var from []int
+	for _, segment := range segments {
+		url = append(url, segment.labels...)
+		pathSlice = append(pathSlice, segment.value)
+		from = append(from, len(segment.labels))
+	}
+	url = append(url, host)
+	return pathMatch{zone: strings.Join(url, "."), from: from, pathSlice: pathSlice}
+}
+
+// newPathSegment returns the segment with the labels used for it
+// by the record's encoding
+func newPathSegment(value string, rec record) pathSegment {
+	if rec.Enc == PathEncodingHex {
+		return pathSegment{value: value, labels: encodeLabels(value)}
+	}
+	return pathSegment{value: value, labels: []string{value}}
+}
+
+// splitPath splits the escaped path into its decoded segments,
+// escaped slashes stay in their segment
+func splitPath(path string, rec record) []pathSegment {
+	var segments []pathSegment
+	for offset := 0; offset < len(path); {
+		end := strings.Index(path[offset:], "/")
+		if end == -1 {
+			end = len(path)
+		} else {
+			end += offset
+		}
+		if end > offset {
+			value, err := url.PathUnescape(path[offset:end])
+			if err != nil {
+				value = path[offset:end]
+			}
+			segment := newPathSegment(value, rec)
+			segment.rest = strings.TrimPrefix(path[end:], "/")
+			segments = append(segments, segment)
+		}
+		offset = end + 1
+	}
+	return segments
+}
+
+// encodeLabels encodes a path segment into DNS labels. Lowercase
+// letters, digits and "-" are kept and every other byte is written
+// as "_" followed by its two hex digits. Encoded segments longer than
+// a label are split into several labels, each one except the last
+// ends with "_" to mark that the segment continues in the next label.
+func encodeLabels(segment string) []string {
+	var labels []string
+	var label strings.Builder
+	for i := 0; i < len(segment); i++ {
+		b := segment[i]
+		unit := string(b)
+		if !(b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '-') {
+			unit = fmt.Sprintf("_%02x", b)
+		}
+		// Keep room for the continuation marker
+		if label.Len()+len(unit) > maxLabelLength-1 {
+			label.WriteByte('_')
+			labels = append(labels, label.String())
+			label.Reset()
+		}
+		label.WriteString(unit)
+	}
+	return append(labels, label.String())
+}
+
+// decodeLabels reverses encodeLabels and returns the path segments
+// of the given labels
+func decodeLabels(labels []string) ([]string, error) {
+	var segments []string
+	var segment []byte
+	for _, label := range labels {
+		// DNS names are case-insensitive, uppercase is always escaped
+		label = strings.ToLower(label)
+		continued := false
+		for i := 0; i < len(label); i++ {
+			if label[i] != '_' {
+				segment = append(segment, label[i])
+				continue
+			}
+			if i == len(label)-1 {
+				continued = true
+				break
+			}
+			if i+2 >= len(label) {
+				return nil, fmt.Errorf("invalid escape in label %q", label)
+			}
+			b, err := strconv.ParseUint(label[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape in label %q", label)
+			}
+			segment = append(segment, byte(b))
+			i += 2
+		}
+		if !continued {
+			segments = append(segments, string(segment))
+			segment = nil
+		}
+	}
+	if segment != nil {
+		return nil, fmt.Errorf("the last label is continued")
+	}
+	return segments, nil
+}
+
+// zoneFromGroups generates the zone from the named groups of the
+// regex. The groups are ordered by name and the first one is the
+// closest to the host, unnamed groups are only available as {$N}.
+// The remainder is cut from the decoded path so it keeps any ".".
+func zoneFromGroups(host, path, decoded string, re *regexp.Regexp, rec record, c Config) (pathMatch, error) {
+	index := re.FindStringSubmatchIndex(path)
+	if index == nil {
+		log.Printf("[txtdirect]: custom regex doesn't match %s", path)
+		return pathMatch{}, ErrPathNoMatch
+	}
+	match := make([]string, len(index)/2)
+	for i := range match {
+		if index[2*i] >= 0 {
+			match[i] = path[index[2*i]:index[2*i+1]]
+		}
+	}
+
+	groups := make(map[string]string)
+	values := make(map[string]string)
+	for i, name := range re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		groups[name] = match[i]
+		// Groups that didn't match anything can't be used as labels
+		if match[i] != "" {
+			values[name] = match[i]
+		}
+	}
+
+	var segments []pathSegment
+	ordered := sortMap(values)
+	reverse(ordered)
+	for _, value := range ordered {
+		segments = append(segments, newPathSegment(value, rec))
+	}
+	pm := newPathMatch(host, segments, c)
+	pm.pathSlice = match[1:]
+	pm.groups = groups
+	pm.remainder = remainderPath(decoded[index[1]:])
+	return pm, nil
+}
+
+// hasNamedGroups checks if any of the regex's groups has a name
+func hasNamedGroups(re *regexp.Regexp) bool {
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// compileRegex compiles the regex of a record. Compiled regexes
+// are kept so each record's regex is only compiled once.
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	regexCache.Lock()
+	defer regexCache.Unlock()
+
+	if re, ok := regexCache.regexes[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
 	if err != nil {
-		// if nothing found, jump into wildcards
-		for i := 1; i <= from && len(txts) == 0; i++ {
-			zoneSlice := strings.Split(zone, ".")
-			zoneSlice[i] = "_"
-			zone = strings.Join(zoneSlice, ".")
-			txts, err = query(zone, ctx, c)
+		return nil, err
+	}
+	// The records aren't trusted, so don't let the cache grow forever
+	if len(regexCache.regexes) >= regexCacheSize {
+		regexCache.regexes = make(map[string]*regexp.Regexp)
+	}
+	regexCache.regexes[pattern] = re
+	return re, nil
+}
+
+// compileGlob compiles the glob of a record's match= field to a regex
+// matching the whole path. "*" matches a part of a segment, "**"
+// matches any number of segments and "/**" also matches nothing.
+// Every wildcard is a group of the regex.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(glob, "/") {
+		return nil, fmt.Errorf("glob %q must start with \"/\"", glob)
+	}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "/**") && (i+3 == len(glob) || glob[i+3] == '/'):
+			pattern.WriteString("(?:/(.*))?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			pattern.WriteString("(.*)")
+			i++
+		case glob[i] == '*':
+			pattern.WriteString("([^/]*)")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
 		}
 	}
-	if err != nil || len(txts) == 0 {
-		return record{}, fmt.Errorf("could not get TXT record: %s", err)
+	pattern.WriteString("$")
+	return compileRegex(pattern.String())
+}
+
+// getFinalRecord finds the final TXT record for the given zone.
+// Path records found on the way delegate the request to deeper path
+// records, the request's path is mapped again using the record's
+// re=, from= or match= with the zone the record was found in as the
+// host. Records without them map the part of the path that isn't in
+// the zone yet.
+func getFinalRecord(match pathMatch, ctx context.Context, c Config, r *http.Request) (record, error) {
+	var chain []string
+	seen := make(map[string]bool)
+	for {
+		rec, prefix, found, err := findPathRecord(match, ctx, c, r)
+		if err != nil || rec.Type != "path" {
+			if err == nil && len(chain) > 0 {
+				log.Printf("[txtdirect]: path chain %s -> %s", strings.Join(chain, " -> "), found)
+			}
+			return rec, err
+		}
+
+		chain = append(chain, found)
+		if seen[absoluteZone(found)] {
+			return rec, &ChainError{chain, ErrChainLoop}
+		}
+		seen[absoluteZone(found)] = true
+		if len(chain) > c.Path.chainDepth() {
+			return rec, &ChainError{chain, ErrChainDepth}
+		}
+
+		host := strings.TrimPrefix(strings.TrimSuffix(found, "."), c.baseZone()+".")
+		path := match.path
+		if rec.Re == "" && rec.From == "" && rec.Match == "" {
+			if prefix.remainder == "" {
+				log.Printf("[txtdirect]: path record in %s has no path left to map", found)
+				return rec, ErrPathNoMatch
+			}
+			match, err = zoneFromPath(host, prefix.remainder, rec, c)
+			// The records further down the chain map the whole path
+			match.path = path
+		} else {
+			match, err = zoneFromPath(host, path, rec, c)
+		}
+		if err != nil {
+			return rec, err
+		}
+		log.Printf("[txtdirect]: path record in %s delegates to %s", found, match.zone)
 	}
+}
 
-	txts[0], err = parsePlaceholders(txts[0], r, pathSlice)
-	rec := record{}
-	if err = rec.Parse(txts[0], r, c); err != nil {
-		return rec, fmt.Errorf("could not parse record: %s", err)
+// findPathRecord finds the record for the given zone and returns the
+// match of the prefix it was found for. In prefix mode the zones of
+// the path's shorter prefixes are tried when the zone doesn't have
+// any records. The wildcards are only tried when none of the exact
+// zones has a record.
+func findPathRecord(match pathMatch, ctx context.Context, c Config, r *http.Request) (record, pathMatch, string, error) {
+	prefixes := match.prefixes
+	if len(prefixes) == 0 {
+		prefixes = []pathMatch{match}
+	}
+	// Shorter exact prefixes are more specific than any wildcard
+	for _, p := range prefixes {
+		rec, err := getPathRecord(p, p.zone, ctx, c, r)
+		if !IsNotFound(err) {
+			if err == nil && p.rest != "" {
+				log.Printf("[txtdirect]: %s matched the path prefix in %s", r.URL.Path, p.zone)
+			}
+			return rec, p, p.zone, err
+		}
 	}
 
-	if rec.Type == "path" {
-		return rec, fmt.Errorf("chaining path is not currently supported")
+	// The wildcards are only tried at the depth of the whole path. Each
+	// segment is replaced by a single wildcard label, even when it's
+	// encoded to several labels. Failed lookups are returned since the
+	// wildcards could hide the zone's records.
+	full := prefixes[0]
+	zone := full.zone
+	zoneSlice := strings.Split(zone, ".")
+	for i := 1; i <= len(full.from); i++ {
+		wildcard := append(append([]string{}, zoneSlice[:i]...), "_")
+		zoneSlice = append(wildcard, zoneSlice[i+full.from[i-1]:]...)
+		zone = strings.Join(zoneSlice, ".")
+		rec, err := getPathRecord(full, zone, ctx, c, r)
+		if !IsNotFound(err) {
+			return rec, full, zone, err
+		}
+	}
+	return record{}, full, zone, &LookupError{zone, ErrNotFound}
+}
+
+// getPathRecord finds the record in the given zone, the placeholders
+// are replaced using the match's path
+func getPathRecord(match pathMatch, zone string, ctx context.Context, c Config, r *http.Request) (record, error) {
+	txts, err := lookup(zone, ctx, c, r)
+	if err != nil {
+		return record{}, err
+	}
+	if len(txts) == 0 {
+		return record{}, &LookupError{zone, ErrNotFound}
+	}
+
+	txt, err := selectRecord(txts, r, c)
+	if err != nil {
+		return record{}, err
+	}
+
+	rec := record{}
+	if err = rec.Parse(txt, r, c); err != nil {
+		return rec, err
+	}
+	values := map[string]string{"rest": match.rest}
+	for name, value := range match.groups {
+		values[name] = value
+	}
+	if err = rec.expandPlaceholders(r, match.pathSlice, values); err != nil {
+		return rec, err
 	}
 
 	return rec, nil
 }
 
+// reverseSegments reverses the order of the segments
+func reverseSegments(input []pathSegment) {
+	last := len(input) - 1
+	for i := 0; i < len(input)/2; i++ {
+		input[i], input[last-i] = input[last-i], input[i]
+	}
+}
+
 // reverse reverses the order of the array
 func reverse(input []string) {
 	last := len(input) - 1
@@ -1,8 +1,17 @@
 package txtdirect
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func Test_zoneFromPath(t *testing.T) {
@@ -163,7 +172,8 @@ func Test_zoneFromPath(t *testing.T) {
 		rec := record{}
 		rec.Re = test.regex
 		rec.From = test.from
-		zone, _, _, err := zoneFromPath(test.host, test.path, rec)
+		match, err := zoneFromPath(test.host, test.path, rec, Config{})
+		zone := match.zone
 		if err != nil {
 			// Check negative tests
 			if err.Error() == test.err.Error() {
@@ -176,3 +186,783 @@ func Test_zoneFromPath(t *testing.T) {
 		}
 	}
 }
+
+func Test_zoneFromPathBaseZone(t *testing.T) {
+	c := Config{BaseZone: "_links"}
+	match, err := zoneFromPath("example.com", "/v1/caddy", record{}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone := match.zone; zone != "_links.caddy.v1.example.com" {
+		t.Errorf("Expected _links.caddy.v1.example.com, got %s", zone)
+	}
+}
+
+func Test_getFinalRecordChain(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.docs.example.com.":        {"v=txtv0;type=path;re=^/docs/([^/]+)"},
+			"_redirect.api.docs.example.com.":    {"v=txtv0;type=path;re=^/docs/api/([^/]+)"},
+			"_redirect.v2.api.docs.example.com.": {"v=txtv0;to=https://api-v2.example.org"},
+			"_redirect.loop.example.com.":        {"v=txtv0;type=path;re=^/loop(?P<page>[^/]*)"},
+		}},
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/docs/api/v2", nil)
+	rec, err := getFinalRecord(pathMatch{zone: "_redirect.docs.example.com", from: []int{1}, pathSlice: []string{"docs"}, path: "/docs/api/v2"}, context.Background(), c, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if rec.To != "https://api-v2.example.org" {
+		t.Errorf("Expected the deepest path record, got %s", rec.To)
+	}
+
+	c.Path.ChainDepth = 1
+	_, err = getFinalRecord(pathMatch{zone: "_redirect.docs.example.com", from: []int{1}, pathSlice: []string{"docs"}, path: "/docs/api/v2"}, context.Background(), c, req)
+	if chainErr, ok := err.(*ChainError); !ok || chainErr.Err != ErrChainDepth || len(chainErr.Chain) != 2 {
+		t.Errorf("Expected the chain to be too long, got %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com/loop", nil)
+	_, err = getFinalRecord(pathMatch{zone: "_redirect.loop.example.com", from: []int{1}, pathSlice: []string{"loop"}, path: "/loop"}, context.Background(), Config{Enable: c.Enable, Source: c.Source}, req)
+	if chainErr, ok := err.(*ChainError); !ok || chainErr.Err != ErrChainLoop {
+		t.Errorf("Expected a loop, got %v", err)
+	}
+}
+
+func TestRedirectPathChainHex(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":                               {"v=txtv0;type=path;re=^/([^/]+)"},
+			"_redirect.docs.example.com.":                          {"v=txtv0;type=path;enc=hex"},
+			"_redirect.file_2ehtml.v1_2e2.docs.example.com.":       {"v=txtv0;to=https://dot.example.org"},
+			"_redirect.file-html.v1-2.docs.example.com.":           {"v=txtv0;to=https://dash.example.org"},
+			"_redirect.named.example.com.":                         {"v=txtv0;type=path;re=^/(?P<a>[^/]+)"},
+			"_redirect.docs.named.example.com.":                    {"v=txtv0;type=path;enc=hex"},
+			"_redirect.file_2ehtml.v1_2e2.docs.named.example.com.": {"v=txtv0;to=https://named.example.org"},
+		}},
+	}
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		// The rest of the path keeps its dots for the nested record
+		{"example.com", "https://dot.example.org"},
+		{"named.example.com", "https://named.example.org"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://"+test.host+"/docs/v1.2/file.html", nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+}
+
+func TestRedirectPathChainDefault(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":                 {"v=txtv0;type=path;re=^/([^/]+);to=https://fallback.example.org"},
+			"_redirect.docs.example.com.":            {"v=txtv0;type=path"},
+			"_redirect.guide.docs.example.com.":      {"v=txtv0;to=https://guide.example.org"},
+			"_redirect.guide.docs.docs.example.com.": {"v=txtv0;to=https://doubled.example.org"},
+		}},
+	}
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		// The record in docs only maps the path after /docs
+		{"/docs/guide", "https://guide.example.org"},
+		{"/docs", "https://fallback.example.org"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com"+test.path, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+}
+
+func TestRedirectPathLookupErrors(t *testing.T) {
+	timeout := &UpstreamError{"127.0.0.1:53", &net.DNSError{Err: "i/o timeout", IsTimeout: true}}
+	servfail := &UpstreamError{"127.0.0.1:53", &net.DNSError{Err: "server misbehaving: SERVFAIL"}}
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: failingSource{
+			RecordSource: &FileSource{records: map[string][]string{
+				"_redirect.example.com.": {"v=txtv0;type=path;to=https://fallback.example.org"},
+			}},
+			failures: map[string]error{
+				"_redirect.timeout.example.com.": timeout,
+				"_redirect.broken.example.com.":  servfail,
+				"_redirect.bogus.example.com.":   &DNSSECError{"_redirect.bogus.example.com.", "answer isn't authenticated"},
+			},
+		},
+	}
+	tests := []struct {
+		path     string
+		code     int
+		location string
+	}{
+		{"/timeout", http.StatusGatewayTimeout, ""},
+		{"/broken", http.StatusBadGateway, ""},
+		{"/bogus", http.StatusBadGateway, ""},
+		// Missing path records still use the record's fallback
+		{"/missing", http.StatusFound, "https://fallback.example.org"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com"+test.path, nil)
+		resp := httptest.NewRecorder()
+		err := Redirect(resp, req, c)
+		code := resp.Code
+		if err != nil {
+			code = StatusCode(err)
+		}
+		if code != test.code {
+			t.Errorf("Test %d: Expected status code %d, got %d (%v)", i, test.code, code, err)
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+	}
+
+	// The fallback is counted for the host record's type
+	fallbacks := FallbacksCount.WithLabelValues("example.com", "path")
+	before := counterValue(fallbacks)
+	req := httptest.NewRequest("GET", "https://example.com/missing", nil)
+	if err := Redirect(httptest.NewRecorder(), req, c); err != nil {
+		t.Fatal(err)
+	}
+	if after := counterValue(fallbacks); after != before+1 {
+		t.Errorf("Expected the fallback to be counted for the path type, got %v fallbacks", after-before)
+	}
+}
+
+// counterValue returns the current value of the counter
+func counterValue(counter prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	counter.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func TestRedirectPathPrefix(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Path:   Path{Prefix: true},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":          {"v=txtv0;type=path"},
+			"_redirect.docs.example.com.":     {"v=txtv0;to=https://docs.example.org/{rest}"},
+			"_redirect.api.docs.example.com.": {"v=txtv0;to=https://api.example.org/{$1}/{rest}"},
+		}},
+	}
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/docs", "https://docs.example.org/"},
+		{"/docs/guide/install/", "https://docs.example.org/guide/install/"},
+		{"/docs/api/v2/users", "https://api.example.org/api/v2/users"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com"+test.path, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+
+	// Without prefix mode only the whole path is looked up
+	c.Path.Prefix = false
+	req := httptest.NewRequest("GET", "https://example.com/docs/guide", nil)
+	_, err := getFinalRecord(pathMatch{zone: "_redirect.guide.docs.example.com", from: []int{1, 1}, pathSlice: []string{"guide", "docs"}, path: "/docs/guide"}, context.Background(), c, req)
+	if !IsNotFound(err) {
+		t.Errorf("Expected the record not to be found, got %v", err)
+	}
+}
+
+// countingSource counts the lookups sent to the source
+type countingSource struct {
+	RecordSource
+	lookups []string
+}
+
+func (s *countingSource) Records(ctx context.Context, zone string) ([]string, error) {
+	s.lookups = append(s.lookups, zone)
+	return s.RecordSource.Records(ctx, zone)
+}
+
+func TestRedirectPathPrefixWildcards(t *testing.T) {
+	source := &countingSource{RecordSource: &FileSource{records: map[string][]string{
+		"_redirect.example.com.":        {"v=txtv0;type=path"},
+		"_redirect.docs.example.com.":   {"v=txtv0;to=https://docs.example.org/{rest}"},
+		"_redirect._._._.example.com.":  {"v=txtv0;to=https://wildcard.example.org"},
+		"_redirect._.blog.example.com.": {"v=txtv0;to=https://blog.example.org"},
+	}}}
+	c := Config{
+		Enable: []string{"host", "path"},
+		Path:   Path{Prefix: true},
+		Source: source,
+	}
+	tests := []struct {
+		path     string
+		expected string
+		lookups  int
+	}{
+		// The exact prefix wins over the deeper wildcard
+		{"/docs/guide/install", "https://docs.example.org/guide/install", 3},
+		{"/a/b/c", "https://wildcard.example.org", 6},
+		// Wildcards are only tried at the depth of the whole path
+		{"/blog/2019", "https://blog.example.org", 3},
+		{"/blog/2019/post", "https://wildcard.example.org", 6},
+	}
+	for i, test := range tests {
+		source.lookups = nil
+		req := httptest.NewRequest("GET", "https://example.com"+test.path, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+		// The host's record is looked up too
+		if lookups := len(source.lookups) - 1; lookups != test.lookups {
+			t.Errorf("Test %d: Expected %d path lookups, got %d: %v", i, test.lookups, lookups, source.lookups)
+		}
+	}
+}
+
+func Test_zoneFromPathRegex(t *testing.T) {
+	tests := []struct {
+		path      string
+		regex     string
+		expected  string
+		pathSlice []string
+		groups    map[string]string
+		err       error
+	}{
+		{
+			"/v2/users/42",
+			"^/(v\\d+)/(?P<resource>[a-z]+)/(?P<id>\\d+)",
+			"_redirect.users.42.example.com",
+			[]string{"v2", "users", "42"},
+			map[string]string{"resource": "users", "id": "42"},
+			nil,
+		},
+		{
+			"/users",
+			"^/(?P<resource>[a-z]+)(?:/(?P<id>\\d+))?",
+			"_redirect.users.example.com",
+			[]string{"users", ""},
+			map[string]string{"resource": "users", "id": ""},
+			nil,
+		},
+		{
+			"/12345-some-path",
+			"\\d+",
+			"_redirect.12345.example.com",
+			[]string{"12345"},
+			nil,
+			nil,
+		},
+		{
+			"/about",
+			"^/(?P<id>\\d+)",
+			"",
+			nil,
+			nil,
+			ErrPathNoMatch,
+		},
+		{
+			"/about",
+			"^/(\\d+)",
+			"",
+			nil,
+			nil,
+			ErrPathNoMatch,
+		},
+	}
+	for i, test := range tests {
+		match, err := zoneFromPath("example.com", test.path, record{Re: test.regex}, Config{})
+		if err != test.err {
+			t.Errorf("Test %d: Expected error %v, got %v", i, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if match.zone != test.expected {
+			t.Errorf("Test %d: Expected zone %s, got %s", i, test.expected, match.zone)
+		}
+		if !reflect.DeepEqual(match.pathSlice, test.pathSlice) {
+			t.Errorf("Test %d: Expected path slice %v, got %v", i, test.pathSlice, match.pathSlice)
+		}
+		if !reflect.DeepEqual(match.groups, test.groups) {
+			t.Errorf("Test %d: Expected groups %v, got %v", i, test.groups, match.groups)
+		}
+	}
+
+	_, err := zoneFromPath("example.com", "/about", record{Re: "^/(?P<id"}, Config{})
+	if recErr, ok := err.(*RecordError); !ok || recErr.Field != "re" {
+		t.Errorf("Expected an invalid re= field, got %v", err)
+	}
+}
+
+func TestRedirectRegexGroups(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":          {"v=txtv0;type=path;re=^/(?P<project>[a-z]+)/(?P<version>v\\d+);to=https://fallback.example.org"},
+			"_redirect.v1.caddy.example.com.": {"v=txtv0;to=https://{project}.example.org/docs/{version}"},
+		}},
+	}
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/caddy/v1", "https://caddy.example.org/docs/v1"},
+		{"/about", "https://fallback.example.org"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com"+test.path, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+}
+
+func TestRedirectPlaceholderFilters(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":          {"v=txtv0;type=path;re=^/(?P<project>[^/]+)/(?P<version>[^/]+)"},
+			"_redirect.v1.caddy.example.com.": {"v=txtv0;to=https://github.com/{project|lower}/docs/tree/{version|trimprefix:v}?lang={?lang:en};type=host"},
+		}},
+	}
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://example.com/Caddy/v1", "https://github.com/caddy/docs/tree/1?lang=en"},
+		{"https://example.com/caddy/v1?lang=de", "https://github.com/caddy/docs/tree/1?lang=de"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+}
+
+func TestRedirectPlaceholderFilterValues(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path", "proxy"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":   {"v=txtv0;type=path;re=^/([^/]+)"},
+			"_redirect._.example.com.": {"v=txtv0;to=https://example.org/{$1|lower}?q={?q:none}&h={>Test|trimprefix:x};code=302"},
+		}},
+	}
+	// Record syntax, filters and placeholders in the values are kept
+	// as they are
+	req := httptest.NewRequest("GET", "https://example.com/A%3Bcode%3D301%22%7C%7B%3Fq%7D?q=x%3Btype%3Dproxy%7Cupper%7B%3Etest%7D", nil)
+	req.Header.Set("Test", `xh";code=301|{$1}`)
+	resp := httptest.NewRecorder()
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.Code != http.StatusFound {
+		t.Errorf("Expected status %d, got %d", http.StatusFound, resp.Code)
+	}
+	expected := `https://example.org/a;code=301"|{?q}?q=x;type=proxy|upper{>test}&h=h";code=301|{$1}`
+	if location := resp.Header().Get("Location"); location != expected {
+		t.Errorf("Expected %s, got %s", expected, location)
+	}
+}
+
+func Test_compileGlob(t *testing.T) {
+	tests := []struct {
+		glob     string
+		path     string
+		captures []string
+	}{
+		{"/blog/*/posts/**", "/blog/2019/posts/go/modules", []string{"2019", "go/modules"}},
+		{"/blog/*/posts/**", "/blog/2019/posts", []string{"2019", ""}},
+		{"/blog/*/posts/**", "/blog/2019/drafts/go", nil},
+		{"/blog/*", "/blog/2019/posts", nil},
+		{"/docs/**/edit", "/docs/edit", []string{""}},
+		{"/docs/**/edit", "/docs/api/v2/edit", []string{"api/v2"}},
+		{"/files/*.pdf", "/files/report.pdf", []string{"report"}},
+		{"/files/*.pdf", "/files/reportxpdf", nil},
+		{"/v*/(a)", "/v2/(a)", []string{"2"}},
+	}
+	for i, test := range tests {
+		re, err := compileGlob(test.glob)
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		match := re.FindStringSubmatch(test.path)
+		if test.captures == nil {
+			if match != nil {
+				t.Errorf("Test %d: Expected %s not to match %s", i, test.glob, test.path)
+			}
+			continue
+		}
+		if match == nil || !reflect.DeepEqual(match[1:], test.captures) {
+			t.Errorf("Test %d: Expected captures %v, got %v", i, test.captures, match)
+		}
+	}
+
+	if _, err := compileGlob("blog/*"); err == nil {
+		t.Errorf("Expected an error for a glob without a leading slash")
+	}
+}
+
+func Test_zoneFromPathGlob(t *testing.T) {
+	tests := []struct {
+		path      string
+		rec       record
+		expected  string
+		pathSlice []string
+		err       error
+	}{
+		{
+			"/blog/2019/posts/go/modules",
+			record{Match: "/blog/*/posts/**"},
+			"_redirect.modules.go.2019.example.com",
+			[]string{"2019", "go/modules"},
+			nil,
+		},
+		{
+			"/blog/2019/posts/go/modules",
+			record{Match: "/blog/*/posts/**", From: "/$2/$1/$3"},
+			"_redirect.modules.2019.go.example.com",
+			[]string{"2019", "go/modules"},
+			nil,
+		},
+		{
+			"/files/v1.2.pdf",
+			record{Match: "/files/*.pdf"},
+			"_redirect.v1-2.example.com",
+			[]string{"v1.2"},
+			nil,
+		},
+		{
+			"/files/v1.2.pdf",
+			record{Match: "/files/*.pdf", Enc: PathEncodingHex},
+			"_redirect.v1_2e2.example.com",
+			[]string{"v1.2"},
+			nil,
+		},
+		{
+			"/about",
+			record{Match: "/blog/**"},
+			"",
+			nil,
+			ErrPathNoMatch,
+		},
+	}
+	for i, test := range tests {
+		match, err := zoneFromPath("example.com", test.path, test.rec, Config{Path: Path{Prefix: true}})
+		if err != test.err {
+			t.Errorf("Test %d: Expected error %v, got %v", i, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if match.zone != test.expected {
+			t.Errorf("Test %d: Expected zone %s, got %s", i, test.expected, match.zone)
+		}
+		if !reflect.DeepEqual(match.pathSlice, test.pathSlice) {
+			t.Errorf("Test %d: Expected path slice %v, got %v", i, test.pathSlice, match.pathSlice)
+		}
+		if len(match.prefixes) != 0 {
+			t.Errorf("Test %d: Expected no prefixes, got %d", i, len(match.prefixes))
+		}
+	}
+}
+
+func TestRedirectPathGlob(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":          {"v=txtv0;type=path;match=/blog/*/posts/**;to=https://fallback.example.org"},
+			"_redirect.intro.go.example.com.": {"v=txtv0;to=https://{$1}.example.org/{$2}"},
+		}},
+	}
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://example.com/blog/go/posts/intro", "https://go.example.org/intro"},
+		{"https://example.com/about", "https://fallback.example.org"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+}
+
+func TestRedirectRegexGroupValues(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path", "proxy"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":   {"v=txtv0;type=path;re=^/(?P<x>[^/]+)"},
+			"_redirect._.example.com.": {"v=txtv0;to=https://example.org/{x};code=302"},
+		}},
+	}
+	// The group's value stays in to= instead of adding a type= field
+	req := httptest.NewRequest("GET", "https://example.com/a;type=proxy", nil)
+	resp := httptest.NewRecorder()
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.Code != http.StatusFound {
+		t.Errorf("Expected status %d, got %d", http.StatusFound, resp.Code)
+	}
+	if location, expected := resp.Header().Get("Location"), "https://example.org/a;type=proxy"; location != expected {
+		t.Errorf("Expected %s, got %s", expected, location)
+	}
+}
+
+func TestRedirectRegexGroupShadowing(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":      {"v=txtv0;type=path;re=^/(?P<path>[^/]+)"},
+			"_redirect.docs.example.com.": {"v=txtv0;to=https://example.org/{path}/{host};code=302"},
+		}},
+	}
+	// Named groups win over the request placeholders with the same name
+	req := httptest.NewRequest("GET", "https://example.com/docs/x", nil)
+	resp := httptest.NewRecorder()
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if location, expected := resp.Header().Get("Location"), "https://example.org/docs/example.com"; location != expected {
+		t.Errorf("Expected %s, got %s", expected, location)
+	}
+}
+
+func Test_zoneFromPathHex(t *testing.T) {
+	long := strings.Repeat("a", 61) + "B" + strings.Repeat("c", 10)
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/v1.2", "_redirect.v1_2e2.example.com"},
+		{"/v1-2", "_redirect.v1-2.example.com"},
+		{"/Docs/api_v2", "_redirect.api_5fv2._44ocs.example.com"},
+		{"/caf%C3%A9", "_redirect.caf_c3_a9.example.com"},
+		{"/a%2Fb/c", "_redirect.c.a_2fb.example.com"},
+		{"/" + long, "_redirect." + strings.Repeat("a", 61) + "_._42" + strings.Repeat("c", 10) + ".example.com"},
+	}
+	for i, test := range tests {
+		match, err := zoneFromPath("example.com", test.path, record{Enc: PathEncodingHex}, Config{})
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if match.zone != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, match.zone)
+		}
+		for _, label := range strings.Split(match.zone, ".") {
+			if len(label) > maxLabelLength {
+				t.Errorf("Test %d: Label %s is longer than %d", i, label, maxLabelLength)
+			}
+		}
+	}
+
+	// The legacy mapping keeps working without enc=
+	match, _ := zoneFromPath("example.com", "/v1.2", record{}, Config{})
+	if match.zone != "_redirect.v1-2.example.com" {
+		t.Errorf("Expected the legacy zone, got %s", match.zone)
+	}
+}
+
+func Test_decodeLabels(t *testing.T) {
+	segments := []string{"v1.2", "Docs", "café", "a/b", "_", strings.Repeat("Ab.", 40)}
+	var labels []string
+	for _, segment := range segments {
+		labels = append(labels, encodeLabels(segment)...)
+	}
+	decoded, err := decodeLabels(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, segments) {
+		t.Errorf("Expected %q, got %q", segments, decoded)
+	}
+
+	for _, labels := range [][]string{{"a_2"}, {"a_zz"}, {"a_"}} {
+		if _, err := decodeLabels(labels); err == nil {
+			t.Errorf("Expected an error for %q", labels)
+		}
+	}
+}
+
+func TestRedirectPathHex(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Path:   Path{Prefix: true},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":                    {"v=txtv0;type=path;enc=hex"},
+			"_redirect.v1_2e2.example.com.":             {"v=txtv0;to=https://v1-2.example.org/{rest}"},
+			"_redirect.v1-2.example.com.":               {"v=txtv0;to=https://v1-dash-2.example.org"},
+			"_redirect._52_45_41_44_4d_45.example.com.": {"v=txtv0;to=https://readme.example.org"},
+		}},
+	}
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/v1.2/caf%C3%A9/a%2Fb", "https://v1-2.example.org/caf%C3%A9/a%2Fb"},
+		{"/v1-2", "https://v1-dash-2.example.org"},
+		{"/README", "https://readme.example.org"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com"+test.path, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+}
+
+func TestRedirectPathHexWildcards(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":        {"v=txtv0;type=path;enc=hex;to=https://fallback.example.org"},
+			"_redirect._.docs.example.com.": {"v=txtv0;to=https://docs.example.org"},
+		}},
+	}
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		// The segment is encoded to two labels, its wildcard is one label
+		{"/docs/" + long, "https://docs.example.org"},
+		// Names longer than DNS allows don't have any records
+		{"/docs" + strings.Repeat("/"+long, 4), "https://fallback.example.org"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com"+test.path, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+
+	// Long names aren't sent to the resolver
+	zone := "_redirect." + strings.Repeat(strings.Repeat("a", 60)+".", 5) + "example.com."
+	_, err := query(zone, context.Background(), Config{Resolver: "127.0.0.1:1"})
+	if !IsNotFound(err) {
+		t.Errorf("Expected %s to not be found, got %v", zone, err)
+	}
+}
+
+func Test_pathPolicyCanonical(t *testing.T) {
+	tests := []struct {
+		policy    pathPolicy
+		path      string
+		canonical string
+		match     string
+	}{
+		{pathPolicy{}, "/Docs//guide/", "/Docs//guide/", "/Docs//guide/"},
+		{pathPolicy{trailingSlash: SlashIgnore}, "/docs/guide/", "/docs/guide/", "/docs/guide"},
+		{pathPolicy{trailingSlash: SlashRedirectAdd}, "/docs/guide", "/docs/guide/", "/docs/guide/"},
+		{pathPolicy{trailingSlash: SlashRedirectAdd}, "/", "/", "/"},
+		{pathPolicy{trailingSlash: SlashRedirectStrip}, "/docs/guide//", "/docs/guide", "/docs/guide"},
+		{pathPolicy{caseInsensitive: true}, "/Docs/Caf%C3%A9", "/Docs/Caf%C3%A9", "/docs/caf%c3%a9"},
+		{pathPolicy{mergeSlashes: true}, "//docs///guide", "/docs/guide", "/docs/guide"},
+		{pathPolicy{SlashRedirectStrip, true, true}, "/Docs//", "/Docs", "/docs"},
+	}
+	for i, test := range tests {
+		canonical, match := test.policy.canonical(test.path)
+		if canonical != test.canonical || match != test.match {
+			t.Errorf("Test %d: Expected %s and %s, got %s and %s", i, test.canonical, test.match, canonical, match)
+		}
+	}
+}
+
+func TestRedirectPathPolicy(t *testing.T) {
+	records := map[string][]string{
+		"_redirect.example.com.":            {"v=txtv0;type=path;slash=redirect-add"},
+		"_redirect.guide.docs.example.com.": {"v=txtv0;to=https://guide.example.org"},
+		"_redirect.example.net.":            {"v=txtv0;type=path;case=sensitive;slashes=keep;enc=hex"},
+		"_redirect.guide.docs.example.net.": {"v=txtv0;to=https://guide.example.net"},
+	}
+	c := Config{
+		Enable: []string{"host", "path"},
+		Path:   Path{CaseInsensitive: true, MergeSlashes: true},
+		Source: &FileSource{records: records},
+	}
+	tests := []struct {
+		url      string
+		code     int
+		expected string
+	}{
+		{"https://example.com/Docs//Guide?a=1", http.StatusMovedPermanently, "/Docs/Guide/?a=1"},
+		{"https://example.com//evil.example//", http.StatusMovedPermanently, "/evil.example/"},
+		{"https://example.com/Docs/Guide/", http.StatusFound, "https://guide.example.org"},
+		{"https://example.net/docs/guide", http.StatusFound, "https://guide.example.net"},
+		{"https://example.net/Docs/guide", http.StatusNotFound, ""},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if resp.Code != test.code || resp.Header().Get("Location") != test.expected {
+			t.Errorf("Test %d: Expected %d %s, got %d %s", i, test.code, test.expected, resp.Code, resp.Header().Get("Location"))
+		}
+	}
+}
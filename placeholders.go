@@ -8,103 +8,205 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+
+	"golang.org/x/net/idna"
 )
 
-var PlaceholderRegex = regexp.MustCompile("{[~>?]?\\w+}")
+// PlaceholderRegex matches placeholders with an optional default value
+// and filters, e.g. {?lang:en} or {$1|trimprefix:v|upper}
+var PlaceholderRegex = regexp.MustCompile("{([~>?$]?\\w+)(:[^{}|]*)?((?:\\|[^{}|]+)*)}")
 
 // parsePlaceholders gets a string input and looks for placeholders inside
 // the string. it will then replace them with the actual data from the request
 func parsePlaceholders(input string, r *http.Request, pathSlice []string) (string, error) {
-	placeholders := PlaceholderRegex.FindAllStringSubmatch(input, -1)
-	for _, placeholder := range placeholders {
-		switch placeholder[0] {
-		case "{uri}":
-			input = strings.Replace(input, "{uri}", r.URL.RequestURI(), -1)
-		case "{dir}":
-			dir, _ := path.Split(r.URL.Path)
-			input = strings.Replace(input, "{dir}", dir, -1)
-		case "{file}":
-			_, file := path.Split(r.URL.Path)
-			input = strings.Replace(input, "{file}", file, -1)
-		case "{host}":
-			input = strings.Replace(input, "{host}", r.Host, -1)
-		case "{hostonly}":
-			// Removes port from host
-			host := r.Host
-			if strings.Contains(r.Host, ":") {
-				hostSlice := strings.Split(r.Host, ":")
-				host = hostSlice[0]
-			}
-			input = strings.Replace(input, "{hostonly}", host, -1)
-		case "{method}":
-			input = strings.Replace(input, "{method}", r.Method, -1)
-		case "{path}":
-			input = strings.Replace(input, "{path}", r.URL.Path, -1)
-		case "{path_escaped}":
-			input = strings.Replace(input, "{path_escaped}", url.QueryEscape(r.URL.Path), -1)
-		case "{port}":
-			input = strings.Replace(input, "{port}", r.URL.Port(), -1)
-		case "{query}":
-			input = strings.Replace(input, "{query}", r.URL.RawQuery, -1)
-		case "{query_escaped}":
-			input = strings.Replace(input, "{query_escaped}", url.QueryEscape(r.URL.RawQuery), -1)
-		case "{uri_escaped}":
-			input = strings.Replace(input, "{uri_escaped}", url.QueryEscape(r.URL.RequestURI()), -1)
-		case "{user}":
-			user, _, ok := r.BasicAuth()
-			if !ok {
-				input = strings.Replace(input, "{user}", "", -1)
-			}
-			input = strings.Replace(input, "{user}", user, -1)
+	return replacePlaceholders(input, r, pathSlice, nil)
+}
+
+// expandPlaceholders replaces the placeholders in the record's URLs.
+// It's only called once the record is parsed, so the request's data
+// can't change the record's other fields.
+func (r *record) expandPlaceholders(req *http.Request, pathSlice []string, values map[string]string) error {
+	fields := []struct {
+		name  string
+		value *string
+	}{{"to", &r.To}, {"root", &r.Root}, {"website", &r.Website}}
+	for _, field := range fields {
+		value, err := replacePlaceholders(*field.value, req, pathSlice, values)
+		if err != nil {
+			return &RecordError{field.name, -1, err.Error()}
 		}
-		/* For multi-level tlds such as "example.co.uk", "co" would be used as {label2},
-		"example" would be {label1} and "uk" would be {label3} */
-		if strings.HasPrefix(placeholder[0], "{label") {
-			nStr := placeholder[0][6 : len(placeholder[0])-1] // get the integer N in "{labelN}"
-			n, err := strconv.Atoi(nStr)
+		*field.value = value
+	}
+	return nil
+}
+
+// replacePlaceholders replaces the placeholders with the given values,
+// the request's data or the path's segments. The default value is used
+// when the value is missing or empty, the placeholders that don't have
+// a value or a default are kept.
+func replacePlaceholders(input string, r *http.Request, pathSlice []string, values map[string]string) (string, error) {
+	var result strings.Builder
+	last := 0
+	for _, index := range PlaceholderRegex.FindAllStringSubmatchIndex(input, -1) {
+		name := input[index[2]:index[3]]
+		// The given values, e.g. the regex's named groups, shadow the
+		// request's placeholders with the same name
+		value, ok := values[name]
+		var err error
+		if !ok {
+			value, ok, err = placeholderValue(name, r, pathSlice)
 			if err != nil {
 				return "", err
 			}
-			if n < 1 {
-				return "", fmt.Errorf("{label0} is not supported")
-			}
-			// Removes port from host
-			host := r.Host
-			if strings.Contains(r.Host, ":") {
-				hostSlice := strings.Split(r.Host, ":")
-				host = hostSlice[0]
-			}
-			labels := strings.Split(host, ".")
-			if n > len(labels) {
-				return "", fmt.Errorf("Cannot parse a label greater than %d", len(labels))
-			}
-			input = strings.Replace(input, placeholder[0], labels[n-1], -1)
-		}
-		if placeholder[0][1] == '>' {
-			want := placeholder[0][2 : len(placeholder[0])-1]
-			for key, values := range r.Header {
-				// Header placeholders (case-insensitive)
-				if strings.EqualFold(key, want) {
-					input = strings.Replace(input, placeholder[0], strings.Join(values, ","), -1)
+		}
+		if index[4] != -1 && value == "" {
+			value, ok = input[index[4]+1:index[5]], true
+		}
+		if !ok {
+			continue
+		}
+		if index[6] != index[7] {
+			for _, filter := range strings.Split(input[index[6]+1:index[7]], "|") {
+				value, err = applyFilter(value, filter)
+				if err != nil {
+					return "", err
 				}
 			}
 		}
-		if placeholder[0][1] == '~' {
-			name := placeholder[0][2 : len(placeholder[0])-1]
-			if cookie, err := r.Cookie(name); err == nil {
-				input = strings.Replace(input, placeholder[0], cookie.Value, -1)
+		result.WriteString(input[last:index[0]])
+		result.WriteString(value)
+		last = index[1]
+	}
+	result.WriteString(input[last:])
+	return result.String(), nil
+}
+
+// placeholderValue returns the value of the placeholder with the given
+// name and whether the placeholder has a value
+func placeholderValue(name string, r *http.Request, pathSlice []string) (string, bool, error) {
+	switch name {
+	case "uri":
+		return r.URL.RequestURI(), true, nil
+	case "dir":
+		dir, _ := path.Split(r.URL.Path)
+		return dir, true, nil
+	case "file":
+		_, file := path.Split(r.URL.Path)
+		return file, true, nil
+	case "host":
+		return r.Host, true, nil
+	case "host_ascii", "host_unicode":
+		host, err := normalizeHost(r.Host)
+		if err != nil {
+			return "", false, err
+		}
+		if name == "host_unicode" {
+			host, err = idna.Display.ToUnicode(host)
+			if err != nil {
+				return "", false, err
+			}
+		}
+		return host, true, nil
+	case "hostonly":
+		// Removes port from host
+		host := r.Host
+		if strings.Contains(r.Host, ":") {
+			hostSlice := strings.Split(r.Host, ":")
+			host = hostSlice[0]
+		}
+		return host, true, nil
+	case "method":
+		return r.Method, true, nil
+	case "path":
+		return r.URL.Path, true, nil
+	case "path_escaped":
+		return url.QueryEscape(r.URL.Path), true, nil
+	case "port":
+		return r.URL.Port(), true, nil
+	case "query":
+		return r.URL.RawQuery, true, nil
+	case "query_escaped":
+		return url.QueryEscape(r.URL.RawQuery), true, nil
+	case "uri_escaped":
+		return url.QueryEscape(r.URL.RequestURI()), true, nil
+	case "user":
+		user, _, _ := r.BasicAuth()
+		return user, true, nil
+	}
+	/* For multi-level tlds such as "example.co.uk", "co" would be used as {label2},
+	"example" would be {label1} and "uk" would be {label3} */
+	if strings.HasPrefix(name, "label") {
+		n, err := strconv.Atoi(name[5:]) // get the integer N in "{labelN}"
+		if err != nil {
+			return "", false, err
+		}
+		if n < 1 {
+			return "", false, fmt.Errorf("{label0} is not supported")
+		}
+		host, err := normalizeHost(r.Host)
+		if err != nil {
+			return "", false, err
+		}
+		labels := strings.Split(host, ".")
+		if n > len(labels) {
+			return "", false, fmt.Errorf("Cannot parse a label greater than %d", len(labels))
+		}
+		return labels[n-1], true, nil
+	}
+	switch name[0] {
+	case '>':
+		for key, values := range r.Header {
+			// Header placeholders (case-insensitive)
+			if strings.EqualFold(key, name[1:]) {
+				return strings.Join(values, ","), true, nil
 			}
 		}
-		if placeholder[0][1] == '?' {
-			query := r.URL.Query()
-			name := placeholder[0][2 : len(placeholder[0])-1]
-			input = strings.Replace(input, placeholder[0], query.Get(name), -1)
+	case '~':
+		if cookie, err := r.Cookie(name[1:]); err == nil {
+			return cookie.Value, true, nil
+		}
+	case '?':
+		return r.URL.Query().Get(name[1:]), true, nil
+	case '$':
+		// Segments that aren't in the path are kept, path records
+		// replace them later
+		n, err := strconv.Atoi(name[1:])
+		if err == nil && n >= 1 && n <= len(pathSlice) {
+			return pathSlice[n-1], true, nil
 		}
 	}
+	return "", false, nil
+}
 
-	for k, v := range pathSlice {
-		input = strings.Replace(input, fmt.Sprintf("{$%d}", k+1), v, -1)
+// applyFilter transforms the value of a placeholder with the filter,
+// the filter's argument is given after ":", e.g. "trimprefix:v"
+func applyFilter(value, filter string) (string, error) {
+	parts := strings.SplitN(filter, ":", 2)
+	name, hasArg := parts[0], len(parts) == 2
+	switch name {
+	case "lower", "upper", "urlencode", "stripext":
+		if hasArg {
+			return "", fmt.Errorf("placeholder filter %q doesn't take an argument", name)
+		}
+	case "trimprefix", "trimsuffix":
+		if !hasArg {
+			return "", fmt.Errorf("placeholder filter %q needs an argument", name)
+		}
+	default:
+		return "", fmt.Errorf("unknown placeholder filter %q", name)
 	}
 
-	return input, nil
+	switch name {
+	case "lower":
+		return strings.ToLower(value), nil
+	case "upper":
+		return strings.ToUpper(value), nil
+	case "urlencode":
+		return url.QueryEscape(value), nil
+	case "stripext":
+		return strings.TrimSuffix(value, path.Ext(value)), nil
+	case "trimprefix":
+		return strings.TrimPrefix(value, parts[1]), nil
+	}
+	return strings.TrimSuffix(value, parts[1]), nil
 }
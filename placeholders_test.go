@@ -155,6 +155,91 @@ func TestParsePlaceholders(t *testing.T) {
 	}
 }
 
+func TestParsePlaceholdersFilters(t *testing.T) {
+	tests := []struct {
+		url       string
+		requested string
+		pathSlice []string
+		expected  string
+	}{
+		{"example.com{path|lower}", "https://example.com/Docs/API", []string{}, "example.com/docs/api"},
+		{"example.com/?q={?q|urlencode}", "https://example.com/?q=a+b%26c", []string{}, "example.com/?q=a+b%26c"},
+		{"example.com/{$1|trimprefix:v}", "https://example.com/v1.2", []string{"v1.2"}, "example.com/1.2"},
+		{"example.com/{label1|upper}", "https://about.example.com", []string{}, "example.com/ABOUT"},
+		{"example.com/{file|stripext}", "https://example.com/docs/guide.html", []string{}, "example.com/guide"},
+		{"example.com/{$1|trimprefix:v|trimsuffix:-rc|upper}", "https://example.com/v2-rc", []string{"v2-rc"}, "example.com/2"},
+		{"example.com/{?lang:en}", "https://example.com/", []string{}, "example.com/en"},
+		{"example.com/{?lang:en}", "https://example.com/?lang=de", []string{}, "example.com/de"},
+		{"example.com/{?lang:EN|lower}", "https://example.com/", []string{}, "example.com/en"},
+		{"example.com/{>Missing:none}", "https://example.com/", []string{}, "example.com/none"},
+		{"example.com/{?lang:}", "https://example.com/", []string{}, "example.com/"},
+		// Placeholders without a value are kept for the path records
+		{"example.com/{$2|lower}/{rest}", "https://example.com/", []string{"a"}, "example.com/{$2|lower}/{rest}"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.requested, nil)
+		result, err := parsePlaceholders(test.url, req, test.pathSlice)
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, result)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/docs/guide", nil)
+	// The values shadow the request's placeholders
+	values := map[string]string{"rest": "guide/Install", "path": "group"}
+	result, err := replacePlaceholders("{rest|lower}/{path}/{host}/{name:x}", req, nil, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "guide/install/group/example.com/x"; result != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestParsePlaceholdersValues(t *testing.T) {
+	// Values that look like record syntax, filters or placeholders
+	// are used as they are
+	req := httptest.NewRequest("GET", "https://example.com/a%7Cupper?q=%7B%3Fq%7D%3Bcode%3D301%22", nil)
+	req.Header.Add("Test", "{>Test}|lower")
+	result, err := parsePlaceholders("{?q|upper}/{>Test:x}/{path}/{$1|lower}", req, []string{"B|{$1}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{?Q};CODE=301"/{>Test}|lower//a|upper/b|{$1}`; result != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestParsePlaceholdersIDN(t *testing.T) {
+	tests := []struct {
+		url      string
+		host     string
+		expected string
+	}{
+		{"{host_ascii}", "Bücher.Example.", "xn--bcher-kva.example"},
+		{"{host_unicode}", "xn--bcher-kva.example:8080", "bücher.example"},
+		{"{host_unicode}", "BÜCHER.example", "bücher.example"},
+		{"{label1}", "Bücher.Example.COM.", "xn--bcher-kva"},
+		{"{label3}", "about.Example.COM.:8080", "com"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com", nil)
+		req.Host = test.host
+		result, err := parsePlaceholders(test.url, req, []string{})
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", test.host, err)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, result)
+		}
+	}
+}
+
 func TestParsePlaceholdersFails(t *testing.T) {
 	tests := []struct {
 		url       string
@@ -176,6 +261,21 @@ func TestParsePlaceholdersFails(t *testing.T) {
 			[]string{},
 			"https://example.com/test",
 		},
+		{
+			"example.com/{path|reverse}",
+			[]string{},
+			"https://example.com/test",
+		},
+		{
+			"example.com/{path|trimprefix}",
+			[]string{},
+			"https://example.com/test",
+		},
+		{
+			"example.com/{path|lower:x}",
+			[]string{},
+			"https://example.com/test",
+		},
 	}
 	for _, test := range tests {
 		req := httptest.NewRequest("GET", test.requested, nil)
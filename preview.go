@@ -0,0 +1,163 @@
+/*
+Copyright 2017 - The TXTdirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mholt/caddy"
+)
+
+const (
+	DefaultPreviewHeader = "X-Txtdirect-Preview"
+	DefaultPreviewZone   = "_redirect-preview"
+)
+
+// Preview contains the configuration for previewing records from
+// a parallel zone before they go live
+type Preview struct {
+	Enable bool
+	Header string
+	Cookie string
+	Zone   string
+	// Allow lists the client networks that can request a preview
+	Allow []*net.IPNet
+}
+
+// SetDefaults sets the default values for the preview config
+// if the fields are empty
+func (p *Preview) SetDefaults() {
+	if p.Header == "" {
+		p.Header = DefaultPreviewHeader
+	}
+	if p.Zone == "" {
+		p.Zone = DefaultPreviewZone
+	}
+}
+
+// requested checks if the request asks for a preview and comes from
+// one of the allowed networks
+func (p Preview) requested(r *http.Request) bool {
+	if !p.Enable || r == nil {
+		return false
+	}
+
+	requested := p.Header != "" && r.Header.Get(p.Header) != ""
+	if !requested && p.Cookie != "" {
+		cookie, err := r.Cookie(p.Cookie)
+		requested = err == nil && cookie.Value != ""
+	}
+	if !requested {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	log.Printf("[txtdirect]: ignoring preview request from %s, client isn't allowed", host)
+	return false
+}
+
+// setHeaders keeps shared caches from serving live responses to preview
+// requests and marks the responses of preview requests as uncacheable
+func (p Preview) setHeaders(w http.ResponseWriter, r *http.Request) {
+	if !p.Enable {
+		return
+	}
+	if p.Header != "" {
+		w.Header().Add("Vary", p.Header)
+	}
+	if p.Cookie != "" {
+		w.Header().Add("Vary", "Cookie")
+	}
+	if p.requested(r) {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+}
+
+// lookup finds the records of the zone and tries the preview zone
+// first when the request asks for a preview
+func lookup(zone string, ctx context.Context, c Config, r *http.Request) ([]string, error) {
+	if c.Preview.requested(r) {
+		preview := c
+		preview.BaseZone = c.Preview.Zone
+		txts, err := query(strings.TrimPrefix(zone, c.baseZone()+"."), ctx, preview)
+		if err == nil {
+			log.Printf("[txtdirect]: using preview records for %s", zone)
+			return txts, nil
+		}
+		log.Printf("[txtdirect]: preview lookup failed, using the live records: %s", err)
+	}
+	return query(zone, ctx, c)
+}
+
+// ParsePreview parses the txtdirect config for the preview zone
+func (p *Preview) ParsePreview(c *caddy.Controller) error {
+	switch c.Val() {
+	case "header", "cookie", "zone":
+		option := c.Val()
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch option {
+		case "header":
+			p.Header = args[0]
+		case "cookie":
+			p.Cookie = args[0]
+		case "zone":
+			p.Zone = args[0]
+		}
+
+	case "allow":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			// Single addresses are allowed without a prefix length
+			if !strings.Contains(arg, "/") {
+				if ip := net.ParseIP(arg); ip != nil && ip.To4() != nil {
+					arg += "/32"
+				} else {
+					arg += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(arg)
+			if err != nil {
+				return c.Err(fmt.Sprintf("invalid preview network %s", arg))
+			}
+			p.Allow = append(p.Allow, network)
+		}
+
+	default:
+		return c.ArgErr() // unhandled option for preview
+	}
+	return nil
+}
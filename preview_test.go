@@ -0,0 +1,153 @@
+package txtdirect
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPreviewRequested(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	p := Preview{
+		Enable: true,
+		Cookie: "txtdirect_preview",
+		Allow:  []*net.IPNet{allowed},
+	}
+	p.SetDefaults()
+
+	tests := []struct {
+		remoteAddr string
+		header     string
+		cookie     string
+		expected   bool
+	}{
+		{"10.1.2.3:4321", "staging", "", true},
+		{"10.1.2.3:4321", "", "staging", true},
+		{"10.1.2.3:4321", "", "", false},
+		{"192.0.2.1:4321", "staging", "", false},
+		{"192.0.2.1:4321", "", "staging", false},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.header != "" {
+			req.Header.Set(DefaultPreviewHeader, test.header)
+		}
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "txtdirect_preview", Value: test.cookie})
+		}
+		if got := p.requested(req); got != test.expected {
+			t.Errorf("Test %d: Expected %t, got %t", i, test.expected, got)
+		}
+	}
+
+	p.Enable = false
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	req.RemoteAddr = "10.1.2.3:4321"
+	req.Header.Set(DefaultPreviewHeader, "staging")
+	if p.requested(req) {
+		t.Errorf("Expected disabled preview to be ignored")
+	}
+}
+
+func Test_lookupPreview(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":         {"v=txtv0;to=https://live.example.org"},
+			"_redirect-preview.example.com.": {"v=txtv0;to=https://preview.example.org"},
+			"_redirect.a.example.com.":       {"v=txtv0;to=https://live-a.example.org"},
+			"_redirect.live.example.com.":    {"v=txtv0;to=https://only-live.example.org"},
+		}},
+		Preview: Preview{Enable: true, Allow: []*net.IPNet{allowed}},
+	}
+	c.Preview.SetDefaults()
+
+	tests := []struct {
+		host       string
+		remoteAddr string
+		expected   string
+	}{
+		{"example.com", "10.1.2.3:4321", "https://preview.example.org"},
+		{"example.com", "192.0.2.1:4321", "https://live.example.org"},
+		// Hosts without preview records fall back to the live records
+		{"live.example.com", "10.1.2.3:4321", "https://only-live.example.org"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set(DefaultPreviewHeader, "staging")
+
+		rec, err := getRecord(test.host, context.Background(), c, req)
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.To != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, rec.To)
+		}
+	}
+
+	// Path records are looked up in the preview zone too
+	c.Source.(*FileSource).records["_redirect-preview.a.example.com."] = []string{"v=txtv0;to=https://preview-a.example.org"}
+	req := httptest.NewRequest("GET", "https://example.com/a", nil)
+	req.RemoteAddr = "10.1.2.3:4321"
+	req.Header.Set(DefaultPreviewHeader, "staging")
+	rec, err := getFinalRecord(pathMatch{zone: "_redirect.a.example.com", from: []int{1}, pathSlice: []string{"a"}, path: "/a"}, context.Background(), c, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.To != "https://preview-a.example.org" {
+		t.Errorf("Expected preview path record, got %s", rec.To)
+	}
+}
+
+func TestRedirectPreviewCaching(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	c := Config{
+		Enable: []string{"host"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.":         {"v=txtv0;to=https://live.example.org;code=301"},
+			"_redirect-preview.example.com.": {"v=txtv0;to=https://preview.example.org;code=301"},
+		}},
+		Preview: Preview{Enable: true, Cookie: "txtdirect_preview", Allow: []*net.IPNet{allowed}},
+	}
+	c.Preview.SetDefaults()
+
+	tests := []struct {
+		remoteAddr   string
+		header       string
+		location     string
+		cacheControl string
+	}{
+		{"10.1.2.3:4321", "staging", "https://preview.example.org", "no-store"},
+		{"10.1.2.3:4321", "", "https://live.example.org", "max-age=604800"},
+		{"192.0.2.1:4321", "staging", "https://live.example.org", "max-age=604800"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.header != "" {
+			req.Header.Set(DefaultPreviewHeader, test.header)
+		}
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %s, got %s", i, test.location, location)
+		}
+		if cacheControl := resp.Header()["Cache-Control"]; len(cacheControl) != 1 || cacheControl[0] != test.cacheControl {
+			t.Errorf("Test %d: Expected Cache-Control %s, got %v", i, test.cacheControl, cacheControl)
+		}
+		// Shared caches must keep the live and preview responses apart
+		if vary := resp.Header()["Vary"]; !reflect.DeepEqual(vary, []string{DefaultPreviewHeader, "Cookie"}) {
+			t.Errorf("Test %d: Expected Vary for the preview header and cookie, got %v", i, vary)
+		}
+	}
+}
@@ -50,6 +50,24 @@ var (
 		Help:      "Total fallbacks triggered for each type",
 	}, []string{"host", "type"})
 
+	StaleRecordsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "stale_records_count_total",
+		Help:      "Total stale records served for each zone when the resolver is unreachable",
+	}, []string{"zone"})
+
+	DNSSECFailuresCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "dnssec_failure_count_total",
+		Help:      "Total fallbacks triggered by DNSSEC validation failures for each host",
+	}, []string{"host"})
+
+	DeduplicatedLookupsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "deduplicated_lookups_count_total",
+		Help:      "Total lookups for each zone that shared an in-flight lookup instead of querying the resolver",
+	}, []string{"zone"})
+
 	once sync.Once
 )
 
@@ -77,6 +95,9 @@ func (p *Prometheus) start() error {
 		prometheus.MustRegister(RequestsByStatus)
 		prometheus.MustRegister(RequestsCountBasedOnType)
 		prometheus.MustRegister(FallbacksCount)
+		prometheus.MustRegister(StaleRecordsCount)
+		prometheus.MustRegister(DNSSECFailuresCount)
+		prometheus.MustRegister(DeduplicatedLookupsCount)
 		http.Handle(p.Path, p.handler)
 		go func() {
 			err := http.ListenAndServe(p.Address, nil)
@@ -0,0 +1,588 @@
+/*
+Copyright 2017 - The TXTdirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDNSPort    = "53"
+	defaultDNSTLSPort = "853"
+	errNoSuchHost     = "no such host"
+	dohMediaType      = "application/dns-message"
+	dohTimeout        = 10 * time.Second
+	pinPrefix         = "sha256/"
+	dnssecUDPSize     = 4096
+
+	DefaultRetryBackoff  = 100 * time.Millisecond
+	DefaultCNAMEDepth    = 8
+	DefaultLookupTimeout = 10 * time.Second
+)
+
+// DNSSEC modes
+const (
+	DNSSECOff     = "off"
+	DNSSECPrefer  = "prefer"
+	DNSSECRequire = "require"
+)
+
+var dohClient = &http.Client{Timeout: dohTimeout}
+
+// DNS contains the options used when querying the custom resolver
+type DNS struct {
+	// ServerName is used to verify the DNS-over-TLS resolver's certificate
+	ServerName string
+	// Pins are the base64 encoded SHA-256 hashes of the DNS-over-TLS
+	// resolver's public keys prefixed with "sha256/"
+	Pins []string
+	// Upstreams lists every resolver when more than one is configured
+	Upstreams []string
+	// Policy is the upstream selection policy: sequential, random or race
+	Policy string
+	// Timeout is the timeout of each query sent to an upstream
+	Timeout time.Duration
+	// MaxFails is the number of consecutive failures after which
+	// an upstream is marked down for Downtime
+	MaxFails int
+	Downtime time.Duration
+	// LookupTimeout limits the whole lookup including the retries
+	LookupTimeout time.Duration
+	// Retries is the number of times a failed lookup is retried,
+	// waiting Backoff before the first retry and doubling it after each one
+	Retries int
+	Backoff time.Duration
+	// TCP forces queries to be sent over TCP
+	TCP bool
+	// BufSize is the EDNS0 UDP buffer size advertised to the resolver
+	BufSize uint16
+	// CNAMEDepth is the maximum number of CNAMEs followed for a zone
+	CNAMEDepth int
+}
+
+// lookupTXT finds the TXT records of the given absolute zone and
+// returns them along with the TTL they can be cached for. The TTL is
+// noTTL when the answer doesn't provide one, e.g. when the system
+// resolver is used.
+func lookupTXT(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	if c.DNS.LookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.DNS.LookupTimeout)
+		defer cancel()
+	}
+
+	backoff := c.DNS.backoff()
+	for attempt := 0; ; attempt++ {
+		txts, ttl, err := lookupTXTOnce(ctx, zone, c)
+		// Missing records and DNSSEC failures won't change by retrying
+		if err == nil || attempt >= c.DNS.Retries || IsNotFound(err) || isDNSSECError(err) {
+			return txts, ttl, err
+		}
+		log.Printf("[txtdirect]: lookup for %s failed, retrying in %s: %s", zone, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, noTTL, err
+		}
+		backoff *= 2
+	}
+}
+
+// lookupTXTOnce sends a single TXT query for the zone without retrying
+func lookupTXTOnce(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	if c.Resolver == "" {
+		if c.DNSSEC == DNSSECRequire {
+			return nil, noTTL, &DNSSECError{zone, "the system resolver doesn't report DNSSEC validation"}
+		}
+		txts, err := net.DefaultResolver.LookupTXT(ctx, zone)
+		return txts, noTTL, err
+	}
+
+	// Resolvers usually answer with the whole CNAME chain, the chain's
+	// target is only queried when the answer stops before its records
+	owner := zone
+	chain := []string{zone}
+	chainTTL := noTTL
+	for {
+		resp, upstream, err := exchangeUpstreams(ctx, txtQuery(owner, c), c)
+		if err != nil {
+			return nil, noTTL, err
+		}
+		if err := checkDNSSEC(resp, zone, c); err != nil {
+			return nil, noTTL, err
+		}
+
+		target, ttl, err := followCNAMEs(resp, owner, &chain, c.DNS.cnameDepth())
+		if err != nil {
+			return nil, noTTL, &net.DNSError{Err: err.Error(), Name: zone, Server: upstream}
+		}
+		if ttl != noTTL && (chainTTL == noTTL || ttl < chainTTL) {
+			chainTTL = ttl
+		}
+		if target == owner || resp.Rcode != dns.RcodeSuccess || hasTXT(resp, target) {
+			if target != zone {
+				log.Printf("[txtdirect]: %s is an alias of %s", zone, target)
+			}
+			txts, ttl, err := answerTXT(resp, target, zone, upstream)
+			if chainTTL != noTTL && ttl != noTTL && chainTTL < ttl {
+				ttl = chainTTL
+			}
+			return txts, ttl, err
+		}
+		owner = target
+	}
+}
+
+// txtQuery creates the TXT query for the given name
+func txtQuery(name string, c Config) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	dnssec := c.DNSSEC == DNSSECPrefer || c.DNSSEC == DNSSECRequire
+	bufSize := c.DNS.BufSize
+	if bufSize == 0 && dnssec {
+		bufSize = dnssecUDPSize
+	}
+	if bufSize > 0 {
+		m.SetEdns0(bufSize, dnssec)
+	}
+	if dnssec {
+		m.AuthenticatedData = true
+	}
+	return m
+}
+
+// followCNAMEs follows the CNAME chain starting at owner through the
+// answer section and returns the last name of the chain along with
+// the lowest TTL of the CNAMEs, or noTTL when there aren't any. The
+// names are appended to chain, which is shared between the queries of
+// a lookup to detect loops.
+func followCNAMEs(resp *dns.Msg, owner string, chain *[]string, maxDepth int) (string, time.Duration, error) {
+	ttl := noTTL
+	for {
+		var target string
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, owner) {
+				target = cname.Target
+				if cnameTTL := time.Duration(cname.Hdr.Ttl) * time.Second; ttl == noTTL || cnameTTL < ttl {
+					ttl = cnameTTL
+				}
+				break
+			}
+		}
+		if target == "" {
+			return owner, ttl, nil
+		}
+
+		for _, name := range *chain {
+			if strings.EqualFold(name, target) {
+				return "", 0, fmt.Errorf("CNAME loop: %s -> %s", strings.Join(*chain, " -> "), target)
+			}
+		}
+		*chain = append(*chain, target)
+		if len(*chain)-1 > maxDepth {
+			return "", 0, fmt.Errorf("CNAME chain is longer than %d: %s", maxDepth, strings.Join(*chain, " -> "))
+		}
+		owner = target
+	}
+}
+
+// hasTXT checks if the answer section contains TXT records for the name
+func hasTXT(resp *dns.Msg, name string) bool {
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDNSSEC checks the AD bit of the given answer. The resolver is
+// trusted to validate the RRSIG chain, so it should be a validating
+// resolver reached over a trusted path, e.g. DNS-over-TLS or localhost.
+func checkDNSSEC(resp *dns.Msg, zone string, c Config) error {
+	if c.DNSSEC != DNSSECPrefer && c.DNSSEC != DNSSECRequire {
+		return nil
+	}
+	// Validating resolvers answer with SERVFAIL for bogus answers, other
+	// SERVFAIL answers are reported as a resolver failure
+	if resp.Rcode == dns.RcodeServerFailure {
+		if ede := dnssecFailure(resp); ede != nil && c.DNSSEC == DNSSECRequire {
+			return &DNSSECError{zone, "resolver answered SERVFAIL: " + ede.String()}
+		}
+		return nil
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil
+	}
+	if resp.AuthenticatedData {
+		return nil
+	}
+	if c.DNSSEC == DNSSECPrefer {
+		log.Printf("[txtdirect]: answer for %s isn't authenticated by DNSSEC", zone)
+		return nil
+	}
+	return &DNSSECError{zone, "answer isn't authenticated"}
+}
+
+// dnssecFailure returns the Extended DNS Error (RFC 8914) of the answer
+// when it reports a DNSSEC validation failure
+func dnssecFailure(resp *dns.Msg) *dns.EDNS0_EDE {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		ede, ok := option.(*dns.EDNS0_EDE)
+		if !ok {
+			continue
+		}
+		switch ede.InfoCode {
+		case dns.ExtendedErrorCodeUnsupportedDNSKEYAlgorithm,
+			dns.ExtendedErrorCodeUnsupportedDSDigestType,
+			dns.ExtendedErrorCodeDNSSECIndeterminate,
+			dns.ExtendedErrorCodeDNSBogus,
+			dns.ExtendedErrorCodeSignatureExpired,
+			dns.ExtendedErrorCodeSignatureNotYetValid,
+			dns.ExtendedErrorCodeDNSKEYMissing,
+			dns.ExtendedErrorCodeRRSIGsMissing,
+			dns.ExtendedErrorCodeNoZoneKeyBitSet,
+			dns.ExtendedErrorCodeNSECMissing:
+			return ede
+		}
+	}
+	return nil
+}
+
+// exchange sends the given DNS query to the resolver. Resolvers given
+// as an https:// URL are queried using DNS-over-HTTPS, resolvers given
+// as tls://host:port are queried using DNS-over-TLS and any other
+// resolver is queried over classic DNS.
+func exchange(ctx context.Context, m *dns.Msg, resolver string, opts DNS) (*dns.Msg, error) {
+	if strings.HasPrefix(resolver, "https://") {
+		return exchangeHTTPS(ctx, m, resolver)
+	}
+
+	client := new(dns.Client)
+	addr := resolverAddress(resolver, defaultDNSPort)
+	if strings.HasPrefix(resolver, "tls://") {
+		tlsConfig, err := opts.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		client.Net = "tcp-tls"
+		client.TLSConfig = tlsConfig
+		addr = resolverAddress(strings.TrimPrefix(resolver, "tls://"), defaultDNSTLSPort)
+	} else if opts.TCP {
+		client.Net = "tcp"
+	}
+	resp, _, err := client.ExchangeContext(ctx, m, addr)
+	if client.Net == "" && err == nil && resp.Truncated {
+		// Large answers don't fit in a UDP response, retry over TCP
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, m, addr)
+	}
+	return resp, err
+}
+
+// tlsConfig returns the TLS config used to connect to DNS-over-TLS
+// resolvers. When pins are given the resolver is authenticated only by
+// the public key of its leaf certificate as described in RFC 7858
+// section 4.2, otherwise the
+// certificate is verified against ServerName or the resolver's address.
+func (d DNS) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: d.ServerName}
+	if len(d.Pins) == 0 {
+		return config, nil
+	}
+
+	pins := make(map[string]bool)
+	for _, pin := range d.Pins {
+		hash, err := parsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+		pins[string(hash)] = true
+	}
+
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		// The handshake only proves the possession of the leaf's key,
+		// the rest of the chain is sent by the server as it likes
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("DNS-over-TLS resolver didn't send a certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if !pins[string(hash[:])] {
+			return fmt.Errorf("DNS-over-TLS resolver's public key doesn't match any of the pins")
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// parsePin decodes the given "sha256/<base64>" public key pin
+func parsePin(pin string) ([]byte, error) {
+	if !strings.HasPrefix(pin, pinPrefix) {
+		return nil, fmt.Errorf("public key pin must start with %s", pinPrefix)
+	}
+	hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 public key pin %s", pin)
+	}
+	return hash, nil
+}
+
+// exchangeHTTPS sends the given DNS query to the endpoint using
+// the wire format described in RFC 8484.
+func exchangeHTTPS(ctx context.Context, m *dns.Msg, endpoint string) (*dns.Msg, error) {
+	// RFC 8484 section 4.1: use ID 0 to make responses cache friendly
+	query := m.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server returned %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != dohMediaType {
+		return nil, fmt.Errorf("unexpected DNS-over-HTTPS content type %q", contentType)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return nil, err
+	}
+	answer.Id = m.Id
+	return answer, nil
+}
+
+// answerTXT extracts the owner's TXT records from the given DNS response.
+// The returned TTL is the lowest TTL of the TXT records, or the negative
+// caching TTL from the SOA record in the authority section when the
+// zone doesn't exist.
+func answerTXT(resp *dns.Msg, owner, zone, addr string) ([]string, time.Duration, error) {
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, negativeTTL(resp), &net.DNSError{Err: errNoSuchHost, Name: zone, Server: addr}
+	default:
+		return nil, noTTL, &net.DNSError{Err: "server misbehaving: " + dns.RcodeToString[resp.Rcode], Name: zone, Server: addr}
+	}
+
+	var txts []string
+	ttl := noTTL
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok || !strings.EqualFold(txt.Hdr.Name, owner) {
+			continue
+		}
+		// A single TXT record can contain multiple strings, join them
+		// the same way net.LookupTXT does
+		txts = append(txts, strings.Join(txt.Txt, ""))
+		if txtTTL := time.Duration(txt.Hdr.Ttl) * time.Second; ttl == noTTL || txtTTL < ttl {
+			ttl = txtTTL
+		}
+	}
+	if len(txts) == 0 {
+		return nil, negativeTTL(resp), &net.DNSError{Err: errNoSuchHost, Name: zone, Server: addr}
+	}
+	return txts, ttl, nil
+}
+
+// negativeTTL returns the negative caching TTL of the given response
+// as described in RFC 2308 section 5.
+func negativeTTL(resp *dns.Msg) time.Duration {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return noTTL
+}
+
+// resolverAddress adds the given default port to the resolver
+// address if it doesn't contain a port.
+func resolverAddress(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, port)
+	}
+	return addr
+}
+
+func (d DNS) cnameDepth() int {
+	if d.CNAMEDepth == 0 {
+		return DefaultCNAMEDepth
+	}
+	return d.CNAMEDepth
+}
+
+// lookupTimeout returns the limit of a whole lookup, lookups shared
+// between requests are limited by it instead of the requests' contexts
+func (d DNS) lookupTimeout() time.Duration {
+	if d.LookupTimeout == 0 {
+		return DefaultLookupTimeout
+	}
+	return d.LookupTimeout
+}
+
+func (d DNS) backoff() time.Duration {
+	if d.Backoff == 0 {
+		return DefaultRetryBackoff
+	}
+	return d.Backoff
+}
+
+// ParseDNS parses the txtdirect config for the custom resolver
+func (d *DNS) ParseDNS(c *caddy.Controller) error {
+	switch c.Val() {
+	case "servername":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		d.ServerName = args[0]
+
+	case "pin":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, pin := range args {
+			if _, err := parsePin(pin); err != nil {
+				return c.Err(err.Error())
+			}
+		}
+		d.Pins = append(d.Pins, args...)
+
+	case "policy":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case PolicySequential, PolicyRandom, PolicyRace:
+			d.Policy = args[0]
+		default:
+			return c.ArgErr()
+		}
+
+	case "timeout", "downtime", "lookuptimeout", "backoff":
+		option := c.Val()
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := time.ParseDuration(args[0])
+		if err != nil || value <= 0 {
+			return c.ArgErr()
+		}
+		switch option {
+		case "timeout":
+			d.Timeout = value
+		case "downtime":
+			d.Downtime = value
+		case "lookuptimeout":
+			d.LookupTimeout = value
+		case "backoff":
+			d.Backoff = value
+		}
+
+	case "maxfails", "retries", "cnamedepth":
+		option := c.Val()
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value < 0 || option != "retries" && value == 0 {
+			return c.ArgErr()
+		}
+		switch option {
+		case "maxfails":
+			d.MaxFails = value
+		case "retries":
+			d.Retries = value
+		case "cnamedepth":
+			d.CNAMEDepth = value
+		}
+
+	case "tcp":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		d.TCP = true
+
+	case "bufsize":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		// Resolvers treat sizes below 512 bytes as 512 (RFC 6891 section 6.2.5)
+		value, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil || value < dns.MinMsgSize {
+			return c.ArgErr()
+		}
+		d.BufSize = uint16(value)
+
+	default:
+		return c.ArgErr() // unhandled option for resolver
+	}
+	return nil
+}
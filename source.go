@@ -0,0 +1,265 @@
+/*
+Copyright 2017 - The TXTdirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Record source backends
+const (
+	SourceDNS  = "dns"
+	SourceFile = "file"
+	SourceHTTP = "http"
+	SourceZone = "zone"
+)
+
+const (
+	httpSourceTimeout  = 10 * time.Second
+	httpSourceMaxBytes = 1 << 20
+)
+
+// RecordSource provides the raw TXT records of a zone.
+// The zone is always absolute, e.g. "_redirect.example.com.".
+// When the zone doesn't have any records, Records must return
+// the error created by NotFoundError.
+type RecordSource interface {
+	Records(ctx context.Context, zone string) ([]string, error)
+}
+
+// NotFoundError returns the error reported when the zone doesn't
+// have any records
+func NotFoundError(zone string) error {
+	return &net.DNSError{Err: errNoSuchHost, Name: zone}
+}
+
+// FileSource serves the records from a YAML or JSON file mapping
+// each zone to its records. A zone can map to a single record or
+// to a list of records.
+type FileSource struct {
+	Path    string
+	records map[string][]string
+}
+
+// NewFileSource loads the records from the given file. Files with
+// the .json extension are parsed as JSON, others as YAML.
+func NewFileSource(path string) (*FileSource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]recordList)
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse records file %s: %s", path, err)
+	}
+
+	records := make(map[string][]string, len(raw))
+	for zone, txts := range raw {
+		records[absoluteZone(zone)] = txts
+	}
+	return &FileSource{Path: path, records: records}, nil
+}
+
+// Records returns the records of the zone found in the file
+func (s *FileSource) Records(ctx context.Context, zone string) ([]string, error) {
+	txts, ok := s.records[absoluteZone(zone)]
+	if !ok || len(txts) == 0 {
+		return nil, NotFoundError(zone)
+	}
+	return append([]string{}, txts...), nil
+}
+
+// recordList is a list of records that can also be given as a single record
+type recordList []string
+
+func (l *recordList) UnmarshalJSON(data []byte) error {
+	var txt string
+	if err := json.Unmarshal(data, &txt); err == nil {
+		*l = recordList{txt}
+		return nil
+	}
+	var txts []string
+	if err := json.Unmarshal(data, &txts); err != nil {
+		return err
+	}
+	*l = txts
+	return nil
+}
+
+func (l *recordList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var txt string
+	if err := unmarshal(&txt); err == nil {
+		*l = recordList{txt}
+		return nil
+	}
+	var txts []string
+	if err := unmarshal(&txts); err != nil {
+		return err
+	}
+	*l = txts
+	return nil
+}
+
+// HTTPSource asks an HTTP endpoint for the records of each zone.
+// The zone is sent as the "zone" query parameter and the endpoint
+// answers with a JSON list of records, or 404 when the zone
+// doesn't have any records.
+type HTTPSource struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPSource returns a record source for the given endpoint
+func NewHTTPSource(endpoint string) (*HTTPSource, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid records endpoint %q", endpoint)
+	}
+	return &HTTPSource{
+		URL:    endpoint,
+		Client: &http.Client{Timeout: httpSourceTimeout},
+	}, nil
+}
+
+// Records fetches the records of the zone from the endpoint
+func (s *HTTPSource) Records(ctx context.Context, zone string) ([]string, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("zone", zone)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, NotFoundError(zone)
+	default:
+		return nil, fmt.Errorf("records endpoint returned %s", resp.Status)
+	}
+
+	var txts []string
+	if err := json.NewDecoder(io.LimitReader(resp.Body, httpSourceMaxBytes)).Decode(&txts); err != nil {
+		return nil, fmt.Errorf("could not decode records for %s: %s", zone, err)
+	}
+	if len(txts) == 0 {
+		return nil, NotFoundError(zone)
+	}
+	return txts, nil
+}
+
+// lookupRecords finds the records of the zone using the configured
+// record source, the TTL is only available for DNS lookups
+func lookupRecords(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	if c.Source == nil {
+		return lookupTXT(ctx, zone, c)
+	}
+	txts, err := c.Source.Records(ctx, zone)
+	return txts, noTTL, err
+}
+
+// absoluteZone lowercases the zone and adds the trailing dot
+func absoluteZone(zone string) string {
+	zone = strings.ToLower(zone)
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+	return zone
+}
+
+// ParseSource parses the txtdirect config for the record source.
+// A nil source means the records are looked up using DNS.
+func ParseSource(c *caddy.Controller) (RecordSource, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	switch args[0] {
+	case SourceDNS:
+		if len(args) != 1 {
+			return nil, c.ArgErr()
+		}
+		return nil, nil
+
+	case SourceFile:
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		source, err := NewFileSource(args[1])
+		if err != nil {
+			return nil, c.Err(err.Error())
+		}
+		return source, nil
+
+	case SourceHTTP:
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		source, err := NewHTTPSource(args[1])
+		if err != nil {
+			return nil, c.Err(err.Error())
+		}
+		return source, nil
+
+	case SourceZone:
+		if len(args) != 2 && len(args) != 3 {
+			return nil, c.ArgErr()
+		}
+		var origin string
+		if len(args) == 3 {
+			origin = args[2]
+		}
+		source, err := NewZoneFileSource(args[1], origin)
+		if err != nil {
+			return nil, c.Err(err.Error())
+		}
+		return source, nil
+
+	default:
+		return nil, c.ArgErr() // unhandled record source
+	}
+}
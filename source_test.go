@@ -0,0 +1,105 @@
+package txtdirect
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"records.yml": `
+_redirect.example.com: "v=txtv0;to=https://example.org;type=host"
+_redirect._.example.com.:
+  - "v=txtv0;to=https://wildcard.example.org;type=host"
+`,
+		"records.json": `{
+  "_redirect.example.com": "v=txtv0;to=https://example.org;type=host",
+  "_redirect._.example.com.": ["v=txtv0;to=https://wildcard.example.org;type=host"]
+}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		source, err := NewFileSource(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		txts, err := source.Records(context.Background(), "_redirect.example.com.")
+		if err != nil || !reflect.DeepEqual(txts, []string{"v=txtv0;to=https://example.org;type=host"}) {
+			t.Errorf("%s: Expected record for _redirect.example.com., got %v, %v", name, txts, err)
+		}
+		if _, err := source.Records(context.Background(), "_redirect.missing.example.com."); !IsNotFound(err) {
+			t.Errorf("%s: Expected not found error, got %v", name, err)
+		}
+
+		// Wildcards are resolved the same way as DNS records
+		c := Config{Enable: []string{"host"}, Source: source}
+		req := httptest.NewRequest("GET", "https://sub.example.com/", nil)
+		rec, err := getRecord("sub.example.com", context.Background(), c, req)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", name, err)
+			continue
+		}
+		if rec.To != "https://wildcard.example.org" {
+			t.Errorf("%s: Expected wildcard record, got %+v", name, rec)
+		}
+	}
+
+	if _, err := NewFileSource(filepath.Join(dir, "missing.yml")); err == nil {
+		t.Errorf("Expected error for missing records file")
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	records := map[string][]string{
+		"_redirect.example.com.": {"v=txtv0;to=https://example.org;type=host"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		txts, ok := records[r.URL.Query().Get("zone")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(txts)
+	}))
+	defer server.Close()
+
+	source, err := NewHTTPSource(server.URL + "/txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Source: source}
+
+	txts, err := query("example.com", context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(txts, records["_redirect.example.com."]) {
+		t.Errorf("Expected %v, got %v", records["_redirect.example.com."], txts)
+	}
+
+	if _, err := query("missing.example.com", context.Background(), c); err == nil {
+		t.Errorf("Expected error for missing zone")
+	}
+
+	if _, err := NewHTTPSource("records.example.com"); err == nil {
+		t.Errorf("Expected error for endpoint without scheme")
+	}
+}
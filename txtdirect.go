@@ -17,14 +17,19 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mholt/caddy/caddyhttp/proxy"
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -35,18 +40,35 @@ const (
 	fallbackDelay     = 300 * time.Millisecond
 	proxyTimeout      = 30 * time.Second
 	status301CacheAge = 604800
+
+	// minWildcardLabels is the number of labels the wildcard walk
+	// never replaces, so it doesn't go past example.com in _.example.com
+	minWildcardLabels = 2
+)
+
+// Wildcard walk modes
+const (
+	WildcardSingle   = "single"
+	WildcardReplace  = "replace"
+	WildcardCollapse = "collapse"
 )
 
 type record struct {
-	Version string
-	To      string
-	Code    int
-	Type    string
-	Vcs     string
-	Website string
-	From    string
-	Root    string
-	Re      string
+	Version  string
+	To       string
+	Code     int
+	Type     string
+	Vcs      string
+	Website  string
+	From     string
+	Root     string
+	Re       string
+	Match    string
+	Enc      string
+	Slash    string
+	Case     string
+	Slashes  string
+	Priority int
 }
 
 // Config contains the middleware's configuration
@@ -54,49 +76,114 @@ type Config struct {
 	Enable     []string
 	Redirect   string
 	Resolver   string
+	DNS        DNS
+	Source     RecordSource
+	Wildcard   string
+	BaseZone   string
+	Path       Path
+	Preview    Preview
+	DNSSEC     string
 	LogOutput  string
+	Cache      RecordCache
 	Gomods     Gomods
 	Prometheus Prometheus
 }
 
+// baseZone returns the label the records are stored under
+func (c Config) baseZone() string {
+	if c.BaseZone == "" {
+		return basezone
+	}
+	return c.BaseZone
+}
+
 // Parse takes a string containing the DNS TXT record and returns
 // a TXTDirect record struct instance.
 // It will return an error if the DNS TXT record is not standard or
 // if the record type is not enabled in the TXTDirect's config.
 func (r *record) Parse(str string, req *http.Request, c Config) error {
-	s := strings.Split(str, ";")
-	for _, l := range s {
+	if isTxtv1(str) {
+		if err := r.parseTxtv1(str, req, c); err != nil {
+			return err
+		}
+		return r.setDefaults(c)
+	}
+
+	offset := 0
+	for _, l := range strings.Split(str, ";") {
+		field, start := strings.SplitN(l, "=", 2)[0], offset
+		invalid := func(reason string) error {
+			return &RecordError{field, start, reason}
+		}
+		offset += utf8.RuneCountInString(l) + 1
+
 		switch {
+		case strings.HasPrefix(l, "case="):
+			l = strings.TrimPrefix(l, "case=")
+			if err := validatePolicy("case", l); err != nil {
+				return invalid(err.Error())
+			}
+			r.Case = l
+
 		case strings.HasPrefix(l, "code="):
 			l = strings.TrimPrefix(l, "code=")
 			i, err := strconv.Atoi(l)
 			if err != nil {
-				return fmt.Errorf("could not parse status code: %s", err)
+				return invalid(fmt.Sprintf("could not parse status code: %s", err))
 			}
 			r.Code = i
 
+		case strings.HasPrefix(l, "enc="):
+			l = strings.TrimPrefix(l, "enc=")
+			if l != PathEncodingHex {
+				return invalid(fmt.Sprintf("unknown path encoding %q", l))
+			}
+			r.Enc = l
+
 		case strings.HasPrefix(l, "from="):
 			l = strings.TrimPrefix(l, "from=")
-			l, err := parsePlaceholders(l, req, []string{})
-			if err != nil {
-				return err
-			}
 			r.From = l
 
+		case strings.HasPrefix(l, "match="):
+			l = strings.TrimPrefix(l, "match=")
+			if _, err := compileGlob(l); err != nil {
+				return invalid(err.Error())
+			}
+			r.Match = l
+
+		case strings.HasPrefix(l, "priority="):
+			l = strings.TrimPrefix(l, "priority=")
+			i, err := strconv.Atoi(l)
+			if err != nil || i < 0 {
+				return invalid(fmt.Sprintf("could not parse priority: %s", l))
+			}
+			r.Priority = i
+
 		case strings.HasPrefix(l, "re="):
 			l = strings.TrimPrefix(l, "re=")
+			if _, err := compileRegex(l); err != nil {
+				return invalid(err.Error())
+			}
 			r.Re = l
 
 		case strings.HasPrefix(l, "root="):
 			l = strings.TrimPrefix(l, "root=")
 			r.Root = l
 
+		case strings.HasPrefix(l, "slash="), strings.HasPrefix(l, "slashes="):
+			key := strings.SplitN(l, "=", 2)[0]
+			l = strings.TrimPrefix(l, key+"=")
+			if err := validatePolicy(key, l); err != nil {
+				return invalid(err.Error())
+			}
+			if key == "slash" {
+				r.Slash = l
+			} else {
+				r.Slashes = l
+			}
+
 		case strings.HasPrefix(l, "to="):
 			l = strings.TrimPrefix(l, "to=")
-			l, err := parsePlaceholders(l, req, []string{})
-			if err != nil {
-				return err
-			}
 			r.To = l
 
 		case strings.HasPrefix(l, "type="):
@@ -107,7 +194,7 @@ func (r *record) Parse(str string, req *http.Request, c Config) error {
 			l = strings.TrimPrefix(l, "v=")
 			r.Version = l
 			if r.Version != "txtv0" {
-				return fmt.Errorf("unhandled version '%s'", r.Version)
+				return invalid(fmt.Sprintf("unhandled version '%s'", r.Version))
 			}
 			log.Print("WARN: txtv0 is not suitable for production")
 
@@ -122,18 +209,29 @@ func (r *record) Parse(str string, req *http.Request, c Config) error {
 		default:
 			tuple := strings.Split(l, "=")
 			if len(tuple) != 2 {
-				return fmt.Errorf("arbitrary data not allowed")
+				field = ""
+				return invalid("arbitrary data not allowed")
 			}
 			continue
 		}
 		if len(l) > 255 {
-			return fmt.Errorf("TXT record cannot exceed the maximum of 255 characters")
+			return invalid("TXT record cannot exceed the maximum of 255 characters")
 		}
 		if r.Type == "dockerv2" && r.To == "" {
-			return fmt.Errorf("[txtdirect]: to= field is required in dockerv2 type")
+			return invalid("to= field is required in dockerv2 type")
 		}
 	}
 
+	return r.setDefaults(c)
+}
+
+// setDefaults sets the default values for the fields that aren't
+// in the record and checks if the record's type is enabled
+func (r *record) setDefaults(c Config) error {
+	if r.Type == "dockerv2" && r.To == "" {
+		return &RecordError{"to", -1, "to= field is required in dockerv2 type"}
+	}
+
 	if r.Code == 0 {
 		r.Code = http.StatusFound
 	}
@@ -143,25 +241,12 @@ func (r *record) Parse(str string, req *http.Request, c Config) error {
 	}
 
 	if !contains(c.Enable, r.Type) {
-		return fmt.Errorf("%s type is not enabled in configuration", r.Type)
+		return &TypeError{r.Type, ErrTypeDisabled}
 	}
 
 	return nil
 }
 
-// getBaseTarget parses the placeholder in the given record's To= field
-// and returns the final address and http status code
-func getBaseTarget(rec record, r *http.Request) (string, int, error) {
-	if strings.ContainsAny(rec.To, "{}") {
-		to, err := parsePlaceholders(rec.To, r, []string{})
-		if err != nil {
-			return "", 0, err
-		}
-		rec.To = to
-	}
-	return rec.To, rec.Code, nil
-}
-
 // contains checks the given slice to see if an item exists
 // in that slice or not
 func contains(array []string, word string) bool {
@@ -178,34 +263,164 @@ func contains(array []string, word string) bool {
 // struct instance. It returns an error when it can't find any txt
 // records or if the TXT record is not standard.
 func getRecord(host string, ctx context.Context, c Config, r *http.Request) (record, error) {
-	txts, err := query(host, ctx, c)
+	txts, err := lookup(host, ctx, c, r)
 	if err != nil {
 		log.Printf("Initial DNS query failed: %s", err)
+		// Only look for wildcards when the zone is known to be missing,
+		// a less specific record shouldn't answer while the resolver
+		// fails or the answer can't be trusted
+		if !IsNotFound(err) {
+			return record{}, err
+		}
 	}
 	// if error present or record empty, jump into wildcards
-	if err != nil || txts[0] == "" {
-		hostSlice := strings.Split(host, ".")
-		hostSlice[0] = "_"
-		host = strings.Join(hostSlice, ".")
-		txts, err = query(host, ctx, c)
+	if err != nil || len(txts) == 0 || txts[0] == "" {
+		for _, wildcard := range wildcardZones(host, c.Wildcard) {
+			txts, err = lookup(wildcard, ctx, c, r)
+			if err == nil && len(txts) > 0 && txts[0] != "" || err != nil && !IsNotFound(err) {
+				break
+			}
+		}
 		if err != nil {
 			log.Printf("Wildcard DNS query failed: %s", err.Error())
 			return record{}, err
 		}
 	}
 
-	if len(txts) != 1 {
-		return record{}, fmt.Errorf("could not parse TXT record with %d records", len(txts))
+	txt, err := selectRecord(txts, r, c)
+	if err != nil {
+		return record{}, err
 	}
 
 	rec := record{}
-	if err = rec.Parse(txts[0], r, c); err != nil {
-		return rec, fmt.Errorf("could not parse record: %s", err)
+	if err = rec.Parse(txt, r, c); err != nil {
+		return rec, err
+	}
+	if err = rec.expandPlaceholders(r, nil, nil); err != nil {
+		return rec, err
 	}
 
 	return rec, nil
 }
 
+// selectRecord picks the record to use when a zone has several TXT
+// records. Strings that aren't txtv0/txtv1 records and records of disabled
+// types are ignored, then the records with the lowest priority= win,
+// then the records whose type= fits the request, e.g. gometa for
+// go-get=1 requests. Any remaining tie is broken by the record's text
+// so the choice doesn't depend on the order the resolver returns.
+func selectRecord(txts []string, r *http.Request, c Config) (string, error) {
+	if len(txts) == 1 {
+		return txts[0], nil
+	}
+
+	type candidate struct {
+		txt      string
+		priority int
+		rank     int
+	}
+	var candidates []candidate
+	for _, txt := range txts {
+		if version := recordField(txt, "v"); version != "txtv0" && version != "txtv1" {
+			continue
+		}
+		recordType := recordField(txt, "type")
+		if recordType == "" {
+			recordType = "host"
+		}
+		if !contains(c.Enable, recordType) {
+			continue
+		}
+		// Records without a priority come after the ones that have one
+		priority := math.MaxInt32
+		if field := recordField(txt, "priority"); field != "" {
+			p, err := strconv.Atoi(field)
+			if err != nil || p < 0 {
+				log.Printf("[txtdirect]: ignoring record with invalid priority: %s", txt)
+				continue
+			}
+			priority = p
+		}
+		candidates = append(candidates, candidate{txt, priority, typeRank(recordType, r)})
+	}
+	if len(candidates) == 0 {
+		return "", ErrNoRecord
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].priority != candidates[j].priority {
+			return candidates[i].priority < candidates[j].priority
+		}
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return candidates[i].txt < candidates[j].txt
+	})
+	return candidates[0].txt, nil
+}
+
+// typeRank ranks the record types for the request, types that are
+// only used for specific clients come first for those clients
+func typeRank(recordType string, r *http.Request) int {
+	switch recordType {
+	case "gometa":
+		if r.URL.Query().Get("go-get") == "1" {
+			return 0
+		}
+		return 2
+	case "dockerv2":
+		if strings.Contains(r.Header.Get("User-Agent"), "Docker-Client") {
+			return 0
+		}
+		return 2
+	}
+	return 1
+}
+
+// recordField returns the value of the given field in the raw record
+func recordField(txt, key string) string {
+	if isTxtv1(txt) {
+		return txtv1Field(txt, key)
+	}
+	for _, field := range strings.Split(txt, ";") {
+		if strings.HasPrefix(field, key+"=") {
+			return strings.TrimPrefix(field, key+"=")
+		}
+	}
+	return ""
+}
+
+// wildcardZones returns the wildcard zones tried for the given host,
+// most specific first. For a.b.team.example.com:
+//
+//	single:   _.b.team.example.com
+//	replace:  _.b.team.example.com, _._.team.example.com, _._._.example.com
+//	collapse: _.b.team.example.com, _.team.example.com, _.example.com
+func wildcardZones(host, mode string) []string {
+	// Removes port from host
+	if strings.Contains(host, ":") {
+		host = strings.Split(host, ":")[0]
+	}
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+
+	first := append([]string{"_"}, labels[1:]...)
+	zones := []string{strings.Join(first, ".")}
+	if mode != WildcardReplace && mode != WildcardCollapse {
+		return zones
+	}
+
+	for i := 1; i < len(labels)-minWildcardLabels; i++ {
+		zone := []string{"_"}
+		if mode == WildcardReplace {
+			for j := 0; j < i; j++ {
+				zone = append(zone, "_")
+			}
+		}
+		zones = append(zones, strings.Join(append(zone, labels[i+1:]...), "."))
+	}
+	return zones
+}
+
 // fallback redirects the request to the given fallback address
 // and if it's not provided it will check txtdirect config for
 // default fallback address
@@ -214,7 +429,7 @@ func fallback(w http.ResponseWriter, r *http.Request, fallback, recordType strin
 	if fallback != "" {
 		log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, fallback)
 		if code == http.StatusMovedPermanently {
-			w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+			cachePermanent(w)
 		}
 		w.Header().Add("Status-Code", strconv.Itoa(code))
 		http.Redirect(w, r, fallback, code)
@@ -228,7 +443,7 @@ func fallback(w http.ResponseWriter, r *http.Request, fallback, recordType strin
 			w.Header().Add("Status-Code", strconv.Itoa(http.StatusForbidden))
 			http.Redirect(w, r, c.Redirect, http.StatusForbidden)
 			if c.Prometheus.Enable {
-				RequestsByStatus.WithLabelValues(r.URL.Host, string(http.StatusForbidden)).Add(1)
+				RequestsByStatus.WithLabelValues(r.URL.Host, strconv.Itoa(http.StatusForbidden)).Add(1)
 			}
 		}
 	} else {
@@ -236,20 +451,56 @@ func fallback(w http.ResponseWriter, r *http.Request, fallback, recordType strin
 	}
 }
 
-// customResolver returns a net.Resolver instance based
-// on the given txtdirect config to use a custom DNS resolver.
-func customResolver(c Config) net.Resolver {
-	return net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{}
-			return d.DialContext(ctx, network, c.Resolver)
-		},
+// cachePermanent lets the clients cache a permanent redirect unless the
+// response is already marked as uncacheable, e.g. for previews
+func cachePermanent(w http.ResponseWriter) {
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
 	}
 }
 
-// query checks the given zone using net.LookupTXT to
-// find TXT records in that zone
+// fallbackError picks the fallback for the error returned while finding
+// the host's record. Errors that don't have a fallback are returned, the
+// status code for them is chosen by StatusCode.
+func fallbackError(w http.ResponseWriter, r *http.Request, host string, err error, c Config) error {
+	switch {
+	case isDNSSECError(err):
+		DNSSECFailuresCount.WithLabelValues(host).Add(1)
+		// The www fallback is the only one that applies without a record
+		if c.Redirect == "" || !contains(c.Enable, "www") {
+			return err
+		}
+		log.Printf("[txtdirect]: %s, fallback triggered.", err)
+		fallback(w, r, "", "dnssec", 0, c)
+		return nil
+
+	case IsNotFound(err):
+		redirect := c.Redirect
+		if redirect == "" && contains(c.Enable, "www") {
+			redirect = strings.Join([]string{defaultProtocol, "://", defaultSub, ".", host}, "")
+		}
+		if redirect == "" {
+			http.NotFound(w, r)
+			if c.Prometheus.Enable {
+				RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusNotFound)).Add(1)
+			}
+			return nil
+		}
+		log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, redirect)
+		cachePermanent(w)
+		w.Header().Add("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
+		http.Redirect(w, r, redirect, http.StatusMovedPermanently)
+		if c.Prometheus.Enable {
+			RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusMovedPermanently)).Add(1)
+		}
+		return nil
+	}
+	return err
+}
+
+// query checks the given zone using the configured resolver to
+// find TXT records in that zone. The results are served from the
+// record cache when it's enabled.
 func query(zone string, ctx context.Context, c Config) ([]string, error) {
 	// Removes port from zone
 	if strings.Contains(zone, ":") {
@@ -257,8 +508,8 @@ func query(zone string, ctx context.Context, c Config) ([]string, error) {
 		zone = zoneSlice[0]
 	}
 
-	if !strings.HasPrefix(zone, basezone) {
-		zone = strings.Join([]string{basezone, zone}, ".")
+	if !strings.HasPrefix(zone, c.baseZone()+".") {
+		zone = strings.Join([]string{c.baseZone(), zone}, ".")
 	}
 
 	// Use absolute zone
@@ -268,21 +519,101 @@ func query(zone string, ctx context.Context, c Config) ([]string, error) {
 	} else {
 		absoluteZone = strings.Join([]string{zone, "."}, "")
 	}
+	// Names generated from long paths can't exist in DNS
+	if len(absoluteZone) > maxNameLength+1 {
+		log.Printf("[txtdirect]: %s is longer than %d bytes", absoluteZone, maxNameLength)
+		return nil, &LookupError{absoluteZone, ErrNotFound}
+	}
 
-	var txts []string
-	var err error
-	if c.Resolver != "" {
-		net := customResolver(c)
-		txts, err = net.LookupTXT(ctx, absoluteZone)
-	} else {
-		txts, err = net.LookupTXT(absoluteZone)
+	if entry, ok := c.Cache.get(absoluteZone); ok {
+		return entry.txts, entry.err
+	}
+	// Don't wait for the resolver while a stale zone is being refreshed
+	if entry, ok := c.Cache.stale(absoluteZone); ok && entry.refreshing {
+		StaleRecordsCount.WithLabelValues(absoluteZone).Add(1)
+		return entry.txts, nil
+	}
+
+	txts, ttl, err := sharedLookup(ctx, absoluteZone, c)
+	if isDNSSECError(err) {
+		return nil, err
 	}
 	if err != nil {
-		return nil, fmt.Errorf("could not get TXT record: %s", err)
+		err = &LookupError{absoluteZone, err}
+		if IsNotFound(err) {
+			c.Cache.setNegative(absoluteZone, err, ttl)
+			return nil, err
+		}
+		if entry, ok := c.Cache.stale(absoluteZone); ok {
+			log.Printf("[txtdirect]: serving stale records for %s: %s", absoluteZone, err)
+			StaleRecordsCount.WithLabelValues(absoluteZone).Add(1)
+			c.Cache.revalidate(absoluteZone, c)
+			return entry.txts, nil
+		}
+		return nil, err
 	}
+	c.Cache.set(absoluteZone, txts, ttl)
 	return txts, nil
 }
 
+// lookups collapses concurrent lookups for the same zone
+var lookups singleflight.Group
+
+type lookupResult struct {
+	txts []string
+	ttl  time.Duration
+}
+
+// sharedLookup looks up the zone's records, sharing the result with
+// every concurrent lookup for the same zone and lookup options. The
+// shared lookup doesn't use any request's context, so a canceled
+// request only stops waiting for it.
+func sharedLookup(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	source := strings.Join(c.resolvers(), ",")
+	if c.Source != nil {
+		source = fmt.Sprintf("%T:%p", c.Source, c.Source)
+	}
+	key := fmt.Sprintf("%s|%s|%+v|%s", source, c.DNSSEC, c.DNS, zone)
+
+	leader := false
+	results := lookups.DoChan(key, func() (interface{}, error) {
+		leader = true
+		lookupCtx, cancel := context.WithTimeout(context.Background(), c.DNS.lookupTimeout())
+		defer cancel()
+		txts, ttl, err := lookupRecords(lookupCtx, zone, c)
+		return lookupResult{txts, ttl}, err
+	})
+
+	select {
+	case result := <-results:
+		if result.Shared && !leader {
+			DeduplicatedLookupsCount.WithLabelValues(zone).Add(1)
+		}
+		v := result.Val.(lookupResult)
+		// Callers are allowed to modify the returned records
+		return append([]string(nil), v.txts...), v.ttl, result.Err
+	case <-ctx.Done():
+		return nil, noTTL, ctx.Err()
+	}
+}
+
+// normalizeHost converts the request's host to the lowercase ASCII
+// form used in DNS, without the port and the trailing dot
+func normalizeHost(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(strings.ToLower(host))
+	if err != nil {
+		return "", fmt.Errorf("invalid host %q: %s", host, err)
+	}
+	return ascii, nil
+}
+
 func isIP(host string) bool {
 	if v6slice := strings.Split(host, ":"); len(v6slice) > 2 {
 		return true
@@ -295,8 +626,14 @@ func isIP(host string) bool {
 // Redirect the request depending on the redirect record found
 func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 	w.Header().Set("Server", "TXTDirect")
+	c.Preview.setHeaders(w, r)
 
-	host := r.Host
+	host, err := normalizeHost(r.Host)
+	if err != nil {
+		log.Printf("[txtdirect]: %s, fallback triggered.", err)
+		fallback(w, r, "", "", 0, c)
+		return nil
+	}
 	path := r.URL.Path
 
 	bl := make(map[string]bool)
@@ -323,53 +660,28 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 
 	rec, err := getRecord(host, r.Context(), c, r)
 	if err != nil {
-		if strings.HasSuffix(err.Error(), "no such host") {
-			if c.Redirect != "" {
-				log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, c.Redirect)
-				w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
-				w.Header().Add("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
-				http.Redirect(w, r, c.Redirect, http.StatusMovedPermanently)
-				if c.Prometheus.Enable {
-					RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusMovedPermanently)).Add(1)
-				}
-				return nil
-			}
-			if contains(c.Enable, "www") {
-				s := strings.Join([]string{defaultProtocol, "://", defaultSub, ".", host}, "")
-				log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, s)
-				w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
-				w.Header().Add("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
-				http.Redirect(w, r, s, http.StatusMovedPermanently)
-				if c.Prometheus.Enable {
-					RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusMovedPermanently)).Add(1)
-				}
-				return nil
-			}
-			http.NotFound(w, r)
-			if c.Prometheus.Enable {
-				RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusNotFound)).Add(1)
-			}
-			return nil
-		}
-		return err
+		return fallbackError(w, r, host, err, c)
 	}
 
 	if !contains(c.Enable, rec.Type) {
-		return fmt.Errorf("option disabled")
+		return &TypeError{rec.Type, ErrTypeDisabled}
 	}
 
-	fallbackURL, code, err := getBaseTarget(rec, r)
-	if err != nil {
-		return err
-	}
+	fallbackURL, code := rec.To, rec.Code
 
-	if rec.Re != "" && rec.From != "" {
+	if rec.Re != "" && (rec.From != "" || rec.Match != "") {
 		fallback(w, r, fallbackURL, rec.Type, code, c)
 		return nil
 	}
 
 	if rec.Type == "path" {
 		RequestsCountBasedOnType.WithLabelValues(host, "path").Add(1)
+		canonical, matchPath := c.Path.policy(rec).canonical(r.URL.EscapedPath())
+		if canonical != r.URL.EscapedPath() {
+			redirectPath(w, r, host, canonical, c)
+			return nil
+		}
+
 		if path == "/" {
 			if rec.Root == "" {
 				fallback(w, r, fallbackURL, rec.Type, code, c)
@@ -377,7 +689,7 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 			}
 			log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, rec.Root)
 			if rec.Code == http.StatusMovedPermanently {
-				w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+				cachePermanent(w)
 			}
 			w.Header().Add("Status-Code", strconv.Itoa(rec.Code))
 			http.Redirect(w, r, rec.Root, rec.Code)
@@ -388,13 +700,22 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		}
 
 		if path != "" {
-			zone, from, pathSlice, err := zoneFromPath(host, path, rec)
-			rec, err = getFinalRecord(zone, from, r.Context(), c, r, pathSlice)
+			match, err := zoneFromPath(host, matchPath, rec, c)
+			var final record
+			if err == nil {
+				final, err = getFinalRecord(match, r.Context(), c, r)
+			}
+			// Failed lookups are handled like the host's, the record's
+			// fallback is only used when the path has no record
+			if isLookupFailure(err) {
+				return fallbackError(w, r, host, err, c)
+			}
 			if err != nil {
 				log.Print("Fallback is triggered because an error has occurred: ", err)
 				fallback(w, r, fallbackURL, rec.Type, code, c)
 				return nil
 			}
+			rec = final
 		}
 	}
 
@@ -402,13 +723,7 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		RequestsCountBasedOnType.WithLabelValues(host, "proxy").Add(1)
 		log.Printf("[txtdirect]: %s > %s", rec.From, rec.To)
 
-		to, _, err := getBaseTarget(rec, r)
-		if err != nil {
-			log.Print("Fallback is triggered because an error has occurred: ", err)
-			fallback(w, r, fallbackURL, rec.Type, code, c)
-			return nil
-		}
-		u, err := url.Parse(to)
+		u, err := url.Parse(rec.To)
 		if err != nil {
 			return err
 		}
@@ -437,15 +752,10 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 
 	if rec.Type == "host" {
 		RequestsCountBasedOnType.WithLabelValues(host, "host").Add(1)
-		to, code, err := getBaseTarget(rec, r)
-		if err != nil {
-			log.Print("Fallback is triggered because an error has occurred: ", err)
-			fallback(w, r, fallbackURL, rec.Type, code, c)
-			return nil
-		}
+		to, code := rec.To, rec.Code
 		log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, to)
 		if code == http.StatusMovedPermanently {
-			w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+			cachePermanent(w)
 		}
 		w.Header().Add("Status-Code", strconv.Itoa(code))
 		http.Redirect(w, r, to, code)
@@ -471,5 +781,5 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		return gomods(w, r, path, c)
 	}
 
-	return fmt.Errorf("record type %s unsupported", rec.Type)
+	return &TypeError{rec.Type, ErrTypeUnsupported}
 }
@@ -15,14 +15,28 @@ package txtdirect
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -72,6 +86,15 @@ var txts = map[string]string{
 	"_redirect.fallbackgometa.test.":          "v=txtv0;type=path",
 	"_redirect.website.fallbackgometa.test.":  "v=txtv0;to=https://github.com/okkur/reposeed-server/;website=https://about.okkur.io/;type=gometa",
 	"_redirect.redirect.fallbackgometa.test.": "v=txtv0;to=https://github.com/okkur/reposeed-server/;type=gometa",
+
+	// DNSSEC
+	"_redirect.signed.dnssec.test.":   "v=txtv0;to=https://signed.dnssec.test;type=host",
+	"_redirect.unsigned.dnssec.test.": "v=txtv0;to=https://unsigned.dnssec.test;type=host",
+}
+
+// Zones that are answered with the AD bit set
+var signedZones = map[string]bool{
+	"_redirect.signed.dnssec.test.": true,
 }
 
 // Testing DNS server port
@@ -81,7 +104,11 @@ const port = 6000
 var server = &dns.Server{Addr: ":" + strconv.Itoa(port), Net: "udp"}
 
 func TestMain(m *testing.M) {
+	// The tests query the server right away, wait until it listens
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
 	go RunDNSServer()
+	<-started
 	os.Exit(m.Run())
 }
 
@@ -146,17 +173,17 @@ func TestParse(t *testing.T) {
 		{
 			"v=txtv0;to=https://example.com/;code=test",
 			record{},
-			fmt.Errorf("could not parse status code"),
+			fmt.Errorf("invalid code= field at offset 32: could not parse status code"),
 		},
 		{
 			"v=txtv1;to=https://example.com/;code=test",
 			record{},
-			fmt.Errorf("unhandled version 'txtv1'"),
+			fmt.Errorf("invalid code= field at offset 32"),
 		},
 		{
 			"v=txtv0;https://example.com/",
 			record{},
-			fmt.Errorf("arbitrary data not allowed"),
+			fmt.Errorf("invalid record at offset 8: arbitrary data not allowed"),
 		},
 		{
 			"v=txtv0;to=https://example.com/caddy;type=path;code=302",
@@ -208,6 +235,9 @@ func TestParse(t *testing.T) {
 		}
 		req, _ := http.NewRequest("GET", "http://example.com?url=https://example.com/testing", nil)
 		err := r.Parse(test.txtRecord, req, c)
+		if err == nil {
+			err = r.expandPlaceholders(req, nil, nil)
+		}
 
 		if err != nil {
 			if test.err == nil || !strings.HasPrefix(err.Error(), test.err.Error()) {
@@ -251,6 +281,331 @@ func TestRedirectBlacklist(t *testing.T) {
 	}
 }
 
+func Test_wildcardZones(t *testing.T) {
+	tests := []struct {
+		host     string
+		mode     string
+		expected []string
+	}{
+		{"a.b.team.example.com", "", []string{"_.b.team.example.com"}},
+		{"a.b.team.example.com", WildcardSingle, []string{"_.b.team.example.com"}},
+		{
+			"a.b.team.example.com",
+			WildcardReplace,
+			[]string{"_.b.team.example.com", "_._.team.example.com", "_._._.example.com"},
+		},
+		{
+			"a.b.team.example.com:8080",
+			WildcardCollapse,
+			[]string{"_.b.team.example.com", "_.team.example.com", "_.example.com"},
+		},
+		{"a.example.com", WildcardCollapse, []string{"_.example.com"}},
+	}
+	for i, test := range tests {
+		zones := wildcardZones(test.host, test.mode)
+		if !reflect.DeepEqual(zones, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, zones)
+		}
+	}
+}
+
+func Test_getRecordWildcard(t *testing.T) {
+	source := &FileSource{records: map[string][]string{
+		"_redirect._.team.example.com.":   {"v=txtv0;to=https://team.example.org;type=host"},
+		"_redirect._._.team.example.com.": {"v=txtv0;to=https://replaced.example.org;type=host"},
+		"_redirect._.b.team.example.com.": {"v=txtv0;to=https://b.example.org;type=host"},
+	}}
+	tests := []struct {
+		host     string
+		mode     string
+		expected string
+	}{
+		// The most specific wildcard wins
+		{"a.b.team.example.com", WildcardCollapse, "https://b.example.org"},
+		{"a.c.team.example.com", WildcardCollapse, "https://team.example.org"},
+		{"a.c.team.example.com", WildcardReplace, "https://replaced.example.org"},
+		{"a.c.team.example.com", WildcardSingle, ""},
+	}
+	for i, test := range tests {
+		c := Config{Enable: []string{"host"}, Source: source, Wildcard: test.mode}
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		rec, err := getRecord(test.host, context.Background(), c, req)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got %+v", i, rec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.To != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, rec.To)
+		}
+	}
+}
+
+// failingSource fails the lookups of the given zones
+type failingSource struct {
+	RecordSource
+	failures map[string]error
+}
+
+func (s failingSource) Records(ctx context.Context, zone string) ([]string, error) {
+	if err, ok := s.failures[zone]; ok {
+		return nil, err
+	}
+	return s.RecordSource.Records(ctx, zone)
+}
+
+func Test_getRecordWildcardErrors(t *testing.T) {
+	servfail := &UpstreamError{"127.0.0.1:53", &net.DNSError{Err: "server misbehaving: SERVFAIL"}}
+	source := failingSource{
+		RecordSource: &FileSource{records: map[string][]string{
+			"_redirect._.team.example.com.": {"v=txtv0;to=https://team.example.org;type=host"},
+		}},
+		failures: map[string]error{
+			"_redirect.a.b.team.example.com.": servfail,
+			"_redirect._.b.team.example.com.": servfail,
+		},
+	}
+	tests := []struct {
+		host string
+		err  error
+	}{
+		// The wildcard doesn't answer while the zone's lookup fails
+		{"a.b.team.example.com", servfail},
+		{"a.c.team.example.com", nil},
+		{"c.b.team.example.com", servfail},
+	}
+	for i, test := range tests {
+		c := Config{Enable: []string{"host"}, Source: source, Wildcard: WildcardCollapse}
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		rec, err := getRecord(test.host, context.Background(), c, req)
+		if test.err == nil {
+			if err != nil || rec.To != "https://team.example.org" {
+				t.Errorf("Test %d: Expected the wildcard, got %+v, %v", i, rec, err)
+			}
+			continue
+		}
+		if !findError(err, func(err error) bool { return err == test.err }) {
+			t.Errorf("Test %d: Expected %v, got %+v, %v", i, test.err, rec, err)
+		}
+	}
+}
+
+func Test_selectRecord(t *testing.T) {
+	tests := []struct {
+		txts      []string
+		url       string
+		userAgent string
+		expected  string
+		shouldErr bool
+	}{
+		{
+			// A single record is used as it is
+			txts:     []string{"to=https://example.org"},
+			expected: "to=https://example.org",
+		},
+		{
+			txts:     []string{"google-site-verification=abc", "v=txtv0;to=https://example.org"},
+			expected: "v=txtv0;to=https://example.org",
+		},
+		{
+			txts: []string{
+				"v=txtv0;to=https://low.example.org;priority=20",
+				"v=txtv0;to=https://high.example.org;priority=10",
+				"v=txtv0;to=https://none.example.org",
+			},
+			expected: "v=txtv0;to=https://high.example.org;priority=10",
+		},
+		{
+			txts: []string{
+				"v=txtv0;to=https://example.org;type=host",
+				"v=txtv0;to=https://example.org/repo;type=gometa",
+			},
+			url:      "https://example.com/pkg?go-get=1",
+			expected: "v=txtv0;to=https://example.org/repo;type=gometa",
+		},
+		{
+			txts: []string{
+				"v=txtv0;to=https://example.org/repo;type=gometa",
+				"v=txtv0;to=https://example.org;type=host",
+			},
+			expected: "v=txtv0;to=https://example.org;type=host",
+		},
+		{
+			txts: []string{
+				"v=txtv0;to=https://example.org;type=host",
+				"v=txtv0;to=https://registry.example.org;type=dockerv2",
+			},
+			userAgent: "docker/18.09 Docker-Client/18.09 (linux)",
+			expected:  "v=txtv0;to=https://registry.example.org;type=dockerv2",
+		},
+		{
+			// Ties are broken the same way regardless of the answer's order
+			txts:     []string{"v=txtv0;to=https://b.example.org", "v=txtv0;to=https://a.example.org"},
+			expected: "v=txtv0;to=https://a.example.org",
+		},
+		{
+			txts: []string{
+				"v=txtv0;to=https://example.org;type=proxy",
+				"v=txtv0;to=https://example.org;type=host",
+			},
+			expected: "v=txtv0;to=https://example.org;type=host",
+		},
+		{
+			txts:      []string{"google-site-verification=abc", "v=spf1 -all"},
+			shouldErr: true,
+		},
+	}
+	for i, test := range tests {
+		if test.url == "" {
+			test.url = "https://example.com"
+		}
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		c := Config{Enable: []string{"host", "gometa", "dockerv2"}}
+
+		txt, err := selectRecord(test.txts, req, c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got %s", i, txt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if txt != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, txt)
+		}
+	}
+}
+
+func Test_queryBaseZone(t *testing.T) {
+	source := &FileSource{records: map[string][]string{
+		"_redirect.example.com.":        {"v=txtv0;to=https://live.example.org"},
+		"_links.example.com.":           {"v=txtv0;to=https://links.example.org"},
+		"_links._redirect.example.com.": {"v=txtv0;to=https://nested.example.org"},
+	}}
+	tests := []struct {
+		zone     string
+		baseZone string
+		expected string
+	}{
+		{"example.com", "", "v=txtv0;to=https://live.example.org"},
+		{"example.com", "_links", "v=txtv0;to=https://links.example.org"},
+		{"_links.example.com", "_links", "v=txtv0;to=https://links.example.org"},
+		// Only the configured base zone is treated as the prefix
+		{"_redirect.example.com", "_links", "v=txtv0;to=https://nested.example.org"},
+	}
+	for i, test := range tests {
+		c := Config{Source: source, BaseZone: test.baseZone}
+		txts, err := query(test.zone, context.Background(), c)
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if txts[0] != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, txts[0])
+		}
+	}
+}
+
+func Test_normalizeHost(t *testing.T) {
+	tests := []struct {
+		host      string
+		expected  string
+		shouldErr bool
+	}{
+		{"example.com", "example.com", false},
+		{"Example.COM.", "example.com", false},
+		{"example.com:8080", "example.com", false},
+		{"Example.com.:8080", "example.com", false},
+		{"bücher.example", "xn--bcher-kva.example", false},
+		{"BÜCHER.example:443", "xn--bcher-kva.example", false},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", false},
+		{"127.0.0.1:8080", "127.0.0.1", false},
+		{"[::1]:8080", "::1", false},
+		{"exa mple.com", "", true},
+	}
+	for i, test := range tests {
+		host, err := normalizeHost(test.host)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error for %s, got %s", i, test.host, host)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if host != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, host)
+		}
+	}
+}
+
+func TestRedirectIDN(t *testing.T) {
+	c := Config{
+		Enable: []string{"host"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.xn--bcher-kva.example.": {"v=txtv0;to=https://books.example.org;type=host;code=302"},
+		}},
+	}
+	for _, host := range []string{"bücher.example", "BÜCHER.Example.", "xn--bcher-kva.example:443"} {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		if err := Redirect(rec, req, c); err != nil {
+			t.Errorf("Unexpected error for %s: %s", host, err)
+			continue
+		}
+		if location := rec.Header().Get("Location"); location != "https://books.example.org" {
+			t.Errorf("Expected %s to redirect to https://books.example.org, got %s", host, location)
+		}
+	}
+}
+
+func TestRedirectPlaceholderValues(t *testing.T) {
+	c := Config{
+		Enable: []string{"host"},
+		Source: &FileSource{records: map[string][]string{
+			"_redirect.example.com.": {"v=txtv0;to=https://example.org/{?q};type=host;code=302"},
+			"_redirect.example.net.": {`v=txtv1;to="https://example.org/{?q}";type=host;code=302`},
+		}},
+	}
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		// Placeholder values can't add fields to the record
+		{"https://example.com/?q=x%3Bcode%3D301", "https://example.org/x;code=301"},
+		{"https://example.net/?q=x%3Bcode%3D301", "https://example.org/x;code=301"},
+		{"https://example.net/?q=x%22%3Btype%3Dproxy", "https://example.org/x\";type=proxy"},
+		// Values are only expanded once
+		{"https://example.com/?q=%7B%3Fq%7D", "https://example.org/{?q}"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if resp.Code != http.StatusFound {
+			t.Errorf("Test %d: Expected status %d, got %d", i, http.StatusFound, resp.Code)
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+}
+
 func Test_query(t *testing.T) {
 	tests := []struct {
 		zone string
@@ -280,8 +635,673 @@ func Test_query(t *testing.T) {
 	}
 }
 
+func Test_queryDoH(t *testing.T) {
+	doh := httptest.NewTLSServer(http.HandlerFunc(handleDoHRequest))
+	defer doh.Close()
+
+	// Trust the testing server's certificate
+	client := dohClient
+	dohClient = doh.Client()
+	defer func() { dohClient = client }()
+
+	tests := []struct {
+		zone string
+		txt  string
+	}{
+		{
+			"_redirect.about.test.",
+			txts["_redirect.about.test."],
+		},
+		{
+			"pkg.test",
+			txts["_redirect.pkg.test."],
+		},
+	}
+	for _, test := range tests {
+		c := Config{
+			Resolver: doh.URL + "/dns-query",
+		}
+		resp, err := query(test.zone, context.Background(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp[0] != test.txt {
+			t.Fatalf("Expected %s, got %s", test.txt, resp[0])
+		}
+	}
+}
+
+func Test_queryDoT(t *testing.T) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := &dns.Server{Listener: listener, Net: "tcp-tls"}
+	go dot.ActivateAndServe()
+	defer dot.Shutdown()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+	wrongPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	// A server with another key that sends the pinned certificate
+	// after its own leaf
+	impostor, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor.Certificate = append(impostor.Certificate, cert.Certificate[0])
+	impostorListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{impostor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostorDoT := &dns.Server{Listener: impostorListener, Net: "tcp-tls"}
+	go impostorDoT.ActivateAndServe()
+	defer impostorDoT.Shutdown()
+
+	tests := []struct {
+		zone      string
+		dns       DNS
+		impostor  bool
+		shouldErr bool
+	}{
+		{
+			"_redirect.about.test.",
+			DNS{Pins: []string{pin}},
+			false,
+			false,
+		},
+		{
+			"_redirect.pkg.test.",
+			DNS{Pins: []string{wrongPin, pin}},
+			false,
+			false,
+		},
+		{
+			"_redirect.about.test.",
+			DNS{Pins: []string{wrongPin}},
+			false,
+			true,
+		},
+		{
+			// The self-signed certificate isn't trusted without a pin
+			"_redirect.about.test.",
+			DNS{ServerName: "localhost"},
+			false,
+			true,
+		},
+		{
+			// Only the leaf's key is proven by the handshake
+			"_redirect.about.test.",
+			DNS{Pins: []string{pin}},
+			true,
+			true,
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Resolver: "tls://" + listener.Addr().String(),
+			DNS:      test.dns,
+		}
+		if test.impostor {
+			c.Resolver = "tls://" + impostorListener.Addr().String()
+		}
+		resp, err := query(test.zone, context.Background(), c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if resp[0] != txts[test.zone] {
+			t.Errorf("Test %d: Expected %s, got %s", i, txts[test.zone], resp[0])
+		}
+	}
+}
+
+func Test_queryTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tcpQueries int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			// Pretend the answer doesn't fit in a UDP response
+			m.Truncated = true
+		} else {
+			atomic.AddInt32(&tcpQueries, 1)
+			parseDNSQuery(m)
+		}
+		w.WriteMsg(m)
+	})
+	tcp := &dns.Server{Listener: listener, Net: "tcp", Handler: handler}
+	udp := &dns.Server{PacketConn: conn, Net: "udp", Handler: handler}
+	go tcp.ActivateAndServe()
+	go udp.ActivateAndServe()
+	defer tcp.Shutdown()
+	defer udp.Shutdown()
+
+	zone := "_redirect.about.test."
+	for i, opts := range []DNS{{}, {TCP: true}} {
+		c := Config{
+			Resolver: listener.Addr().String(),
+			DNS:      opts,
+		}
+		resp, err := query(zone, context.Background(), c)
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if resp[0] != txts[zone] {
+			t.Errorf("Test %d: Expected %s, got %s", i, txts[zone], resp[0])
+		}
+	}
+	if n := atomic.LoadInt32(&tcpQueries); n != 2 {
+		t.Errorf("Expected 2 queries over TCP, got %d", n)
+	}
+}
+
+func Test_queryRetries(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int32
+	udp := &dns.Server{PacketConn: conn, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		// Fail the first two queries
+		if atomic.AddInt32(&queries, 1) <= 2 {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			parseDNSQuery(m)
+		}
+		w.WriteMsg(m)
+	})}
+	go udp.ActivateAndServe()
+	defer udp.Shutdown()
+
+	zone := "_redirect.about.test."
+	c := Config{
+		Resolver: conn.LocalAddr().String(),
+		DNS: DNS{
+			Retries: 1,
+			Backoff: time.Millisecond,
+		},
+	}
+	if _, err := query(zone, context.Background(), c); err == nil {
+		t.Errorf("Expected error after running out of retries")
+	}
+
+	c.DNS.Retries = 2
+	resp, err := query(zone, context.Background(), c)
+	if err != nil {
+		t.Fatalf("Expected lookup to succeed after retrying, got %s", err)
+	}
+	if resp[0] != txts[zone] {
+		t.Errorf("Expected %s, got %s", txts[zone], resp[0])
+	}
+}
+
+func Test_querySingleflight(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int32
+	udp := &dns.Server{PacketConn: conn, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		// Keep the lookup in flight while the other requests come in
+		time.Sleep(200 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		parseDNSQuery(m)
+		w.WriteMsg(m)
+	})}
+	go udp.ActivateAndServe()
+	defer udp.Shutdown()
+
+	zone := "_redirect.about.test."
+	c := Config{
+		Resolver: conn.LocalAddr().String(),
+		DNS:      DNS{Timeout: time.Second},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := query(zone, context.Background(), c)
+			if err == nil && resp[0] != txts[zone] {
+				err = fmt.Errorf("expected %s, got %s", txts[zone], resp[0])
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("Expected concurrent lookups to share 1 query, got %d", n)
+	}
+}
+
+func Test_querySingleflightCancel(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int32
+	udp := &dns.Server{PacketConn: conn, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(200 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		parseDNSQuery(m)
+		w.WriteMsg(m)
+	})}
+	go udp.ActivateAndServe()
+	defer udp.Shutdown()
+
+	zone := "_redirect.about.test."
+	c := Config{
+		Resolver: conn.LocalAddr().String(),
+		DNS:      DNS{Timeout: time.Second},
+	}
+
+	// The first request starts the lookup and goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := query(zone, ctx, c)
+		leader <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	follower := make(chan error, 1)
+	go func() {
+		resp, err := query(zone, context.Background(), c)
+		if err == nil && resp[0] != txts[zone] {
+			err = fmt.Errorf("expected %s, got %s", txts[zone], resp[0])
+		}
+		follower <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if err := <-leader; !findError(err, func(err error) bool { return err == context.Canceled }) {
+		t.Errorf("Expected the canceled request to get %v, got %v", context.Canceled, err)
+	}
+	if err := <-follower; err != nil {
+		t.Errorf("Expected the other request to get the records, got %s", err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("Expected the requests to share 1 query, got %d", n)
+	}
+
+	// Lookups with other options aren't shared
+	atomic.StoreInt32(&queries, 0)
+	var wg sync.WaitGroup
+	for _, bufSize := range []uint16{0, 1232} {
+		wg.Add(1)
+		go func(bufSize uint16) {
+			defer wg.Done()
+			c := c
+			c.DNS.BufSize = bufSize
+			query("_redirect.pkg.test.", context.Background(), c)
+		}(bufSize)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("Expected lookups with different options to send 2 queries, got %d", n)
+	}
+}
+
+func Test_queryCNAME(t *testing.T) {
+	cnames := map[string]string{
+		"_redirect.alias.test.":   "_redirect.partial.test.",
+		"_redirect.partial.test.": "_redirect.target.test.",
+		"_redirect.loop1.test.":   "_redirect.loop2.test.",
+		"_redirect.loop2.test.":   "_redirect.loop1.test.",
+		"_redirect.deep1.test.":   "_redirect.deep2.test.",
+		"_redirect.deep2.test.":   "_redirect.deep3.test.",
+		"_redirect.deep3.test.":   "_redirect.target.test.",
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: conn, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		name := r.Question[0].Name
+		// Aliases are answered with their own CNAME only so the
+		// rest of the chain has to be queried explicitly
+		if target, ok := cnames[name]; ok {
+			m.Answer = append(m.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 30},
+				Target: target,
+			})
+		} else if name == "_redirect.target.test." {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{"v=txtv0;to=https://target.test"},
+			})
+		}
+		w.WriteMsg(m)
+	})}
+	go udp.ActivateAndServe()
+	defer udp.Shutdown()
+
+	tests := []struct {
+		zone      string
+		depth     int
+		shouldErr bool
+	}{
+		{"_redirect.partial.test.", 0, false},
+		{"_redirect.alias.test.", 0, false},
+		{"_redirect.loop1.test.", 0, true},
+		{"_redirect.deep1.test.", 3, false},
+		{"_redirect.deep1.test.", 2, true},
+	}
+	for i, test := range tests {
+		c := Config{
+			Resolver: conn.LocalAddr().String(),
+			DNS:      DNS{CNAMEDepth: test.depth},
+		}
+		txts, ttl, err := lookupTXT(context.Background(), test.zone, c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got %v", i, txts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if len(txts) != 1 || txts[0] != "v=txtv0;to=https://target.test" {
+			t.Errorf("Test %d: Expected the target's record, got %v", i, txts)
+		}
+		// The chain can't be cached for longer than its CNAMEs
+		if ttl != 30*time.Second {
+			t.Errorf("Test %d: Expected TTL of 30s, got %s", i, ttl)
+		}
+	}
+}
+
+func Test_answerTXTTTL(t *testing.T) {
+	txt := func(ttl uint32) dns.RR {
+		return &dns.TXT{
+			Hdr: dns.RR_Header{Name: "_redirect.ttl.test.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: []string{"v=txtv0;to=https://ttl.test"},
+		}
+	}
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}}
+	tests := []struct {
+		rcode    int
+		answer   []dns.RR
+		ns       []dns.RR
+		expected time.Duration
+	}{
+		{dns.RcodeSuccess, []dns.RR{txt(60), txt(30)}, nil, 30 * time.Second},
+		// A TTL of zero is kept so the records aren't cached
+		{dns.RcodeSuccess, []dns.RR{txt(0), txt(60)}, nil, 0},
+		{dns.RcodeNameError, nil, []dns.RR{soa}, 0},
+		{dns.RcodeNameError, nil, nil, noTTL},
+	}
+	for i, test := range tests {
+		resp := new(dns.Msg)
+		resp.Rcode = test.rcode
+		resp.Answer = test.answer
+		resp.Ns = test.ns
+		_, ttl, _ := answerTXT(resp, "_redirect.ttl.test.", "_redirect.ttl.test.", "127.0.0.1:53")
+		if ttl != test.expected {
+			t.Errorf("Test %d: Expected TTL %s, got %s", i, test.expected, ttl)
+		}
+	}
+}
+
+// selfSignedCert generates a certificate for the DNS-over-TLS testing server
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func Test_queryDNSSEC(t *testing.T) {
+	tests := []struct {
+		zone      string
+		resolver  string
+		dnssec    string
+		shouldErr bool
+	}{
+		{
+			"_redirect.signed.dnssec.test.",
+			"127.0.0.1:" + strconv.Itoa(port),
+			DNSSECRequire,
+			false,
+		},
+		{
+			"_redirect.unsigned.dnssec.test.",
+			"127.0.0.1:" + strconv.Itoa(port),
+			DNSSECRequire,
+			true,
+		},
+		{
+			"_redirect.unsigned.dnssec.test.",
+			"127.0.0.1:" + strconv.Itoa(port),
+			DNSSECPrefer,
+			false,
+		},
+		{
+			"_redirect.unsigned.dnssec.test.",
+			"127.0.0.1:" + strconv.Itoa(port),
+			DNSSECOff,
+			false,
+		},
+		{
+			"_redirect.signed.dnssec.test.",
+			"",
+			DNSSECRequire,
+			true,
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Resolver: test.resolver,
+			DNSSEC:   test.dnssec,
+		}
+		resp, err := query(test.zone, context.Background(), c)
+		if test.shouldErr {
+			if !isDNSSECError(err) {
+				t.Errorf("Test %d: Expected DNSSEC error, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if resp[0] != txts[test.zone] {
+			t.Errorf("Test %d: Expected %s, got %s", i, txts[test.zone], resp[0])
+		}
+	}
+}
+
+func TestRedirectDNSSECE2e(t *testing.T) {
+	tests := []struct {
+		url      string
+		enable   []string
+		redirect string
+		code     int
+		location string
+	}{
+		{
+			"https://signed.dnssec.test",
+			[]string{"host"},
+			"",
+			http.StatusFound,
+			"https://signed.dnssec.test",
+		},
+		{
+			"https://unsigned.dnssec.test",
+			[]string{"host"},
+			"",
+			http.StatusBadGateway,
+			"",
+		},
+		{
+			"https://unsigned.dnssec.test",
+			[]string{"host"},
+			"https://fallback.example.com",
+			http.StatusBadGateway,
+			"",
+		},
+		{
+			"https://unsigned.dnssec.test",
+			[]string{"host", "www"},
+			"https://fallback.example.com",
+			http.StatusForbidden,
+			"https://fallback.example.com",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   test.enable,
+			Redirect: test.redirect,
+			DNSSEC:   DNSSECRequire,
+		}
+		err := Redirect(resp, req, c)
+		code := resp.Code
+		if err != nil {
+			// The status code is written by the caller
+			code = StatusCode(err)
+		}
+		if code != test.code {
+			t.Errorf("Test %d: Expected status code %d for %s, got %d", i, test.code, test.url, code)
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %s for %s, got %s", i, test.location, test.url, location)
+		}
+	}
+}
+
+// Validating resolvers answer with SERVFAIL when the signatures are
+// bogus and tell it apart from other failures with an Extended DNS Error
+func Test_queryDNSSECServfail(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		if r.Question[0].Name == "_redirect.bogus.dnssec.test." {
+			m.SetEdns0(dnssecUDPSize, true)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus})
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	tests := []struct {
+		zone      string
+		dnssec    string
+		dnssecErr bool
+	}{
+		{"_redirect.bogus.dnssec.test.", DNSSECRequire, true},
+		{"_redirect.bogus.dnssec.test.", DNSSECPrefer, false},
+		{"_redirect.bogus.dnssec.test.", "", false},
+		// SERVFAIL without a DNSSEC error is an outage
+		{"_redirect.outage.dnssec.test.", DNSSECRequire, false},
+	}
+	for i, test := range tests {
+		c := Config{
+			Resolver: conn.LocalAddr().String(),
+			DNSSEC:   test.dnssec,
+		}
+		_, err := query(test.zone, context.Background(), c)
+		if err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+			continue
+		}
+		if isDNSSECError(err) != test.dnssecErr {
+			t.Errorf("Test %d: Expected DNSSEC error to be %t, got %s", i, test.dnssecErr, err)
+		}
+		if !test.dnssecErr && StatusCode(err) != http.StatusBadGateway {
+			t.Errorf("Test %d: Expected a resolver failure, got %s", i, err)
+		}
+	}
+
+	// Bogus answers don't mark the resolver as down
+	resolverHealth.success(conn.LocalAddr().String())
+	c := Config{Resolver: conn.LocalAddr().String(), DNSSEC: DNSSECRequire, DNS: DNS{MaxFails: 1}}
+	query("_redirect.bogus.dnssec.test.", context.Background(), c)
+	if healthy := resolverHealth.healthy([]string{c.Resolver}, time.Now()); healthy != 1 {
+		t.Errorf("Expected the resolver to stay up after a bogus answer")
+	}
+
+	// Outages in require mode can still be served from the stale records
+	c.Cache = RecordCache{Enable: true, Grace: time.Minute}
+	c.Cache.SetDefaults()
+	c.Cache.store.set("_redirect.outage.dnssec.test.", []string{"v=txtv0;to=https://stale.test"}, nil, time.Now().Add(-time.Second))
+	txts, err := query("_redirect.outage.dnssec.test.", context.Background(), c)
+	if err != nil || len(txts) != 1 || txts[0] != "v=txtv0;to=https://stale.test" {
+		t.Errorf("Expected the stale records, got %v, %v", txts, err)
+	}
+}
+
 func parseDNSQuery(m *dns.Msg) {
 	for _, q := range m.Question {
+		m.AuthenticatedData = signedZones[q.Name]
 		switch q.Qtype {
 		case dns.TypeTXT:
 			log.Printf("Query for %s\n", q.Name)
@@ -306,12 +1326,41 @@ func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	w.WriteMsg(m)
 }
 
+// handleDoHRequest is a DNS-over-HTTPS stand-in for the testing DNS server
+func handleDoHRequest(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	parseDNSQuery(m)
+	packed, err := m.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(packed)
+}
+
 func RunDNSServer() {
 	dns.HandleFunc("test.", handleDNSRequest)
 	err := server.ListenAndServe()
 	defer server.Shutdown()
 	if err != nil {
-		log.Printf("Failed to start server: %s\n ", err.Error())
+		log.Fatalf("Failed to start server: %s\n ", err.Error())
 	}
 }
 
@@ -442,22 +1491,22 @@ func TestConfigE2e(t *testing.T) {
 		enable []string
 	}{
 		{
-			"https://e2e.txtdirect",
-			txts["_redirect.path.txtdirect."],
+			"https://host.e2e.test",
+			txts["_redirect.host.e2e.test."],
 			[]string{},
 		},
 		{
-			"https://path.txtdirect/test",
-			txts["_redirect.path.e2e.txtdirect."],
+			"https://path.e2e.test/test",
+			txts["_redirect.path.e2e.test."],
 			[]string{"host"},
 		},
 		{
-			"https://gometa.txtdirect",
-			txts["_redirect.gometa.txtdirect."],
+			"https://pkg.txtdirect.test",
+			txts["_redirect.pkg.txtdirect.test."],
 			[]string{"host"},
 		},
 	}
-	for _, test := range tests {
+	for i, test := range tests {
 		req := httptest.NewRequest("GET", test.url, nil)
 		resp := httptest.NewRecorder()
 		c := Config{
@@ -465,8 +1514,11 @@ func TestConfigE2e(t *testing.T) {
 			Enable:   test.enable,
 		}
 		err := Redirect(resp, req, c)
-		if err == nil && !strings.Contains(err.Error(), "option disabled") {
-			t.Fatalf("required option is not enabled, but there is no error returned")
+		if !IsTypeDisabled(err) {
+			t.Errorf("Test %d: required option is not enabled, expected a disabled type error, got %v", i, err)
+		}
+		if code := StatusCode(err); code != http.StatusNotFound {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, http.StatusNotFound, code)
 		}
 	}
 }
@@ -0,0 +1,281 @@
+/*
+Copyright 2017 - The TXTdirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const txtv1Prefix = "v=txtv1"
+
+// recordTypes are the types a txtv1 record can have
+var recordTypes = []string{"host", "path", "gometa", "gomods", "proxy", "dockerv2"}
+
+// txtField is a key/value pair of a txtv1 record
+type txtField struct {
+	key    string
+	value  string
+	offset int
+}
+
+// isTxtv1 checks if the raw record uses the txtv1 grammar
+func isTxtv1(str string) bool {
+	return str == txtv1Prefix || strings.HasPrefix(str, txtv1Prefix+";")
+}
+
+// splitTxtv1 splits a txtv1 record into its fields. Fields are
+// separated by ";" and keys are separated from values by the first "=".
+// Values can be quoted with double quotes and any character can be
+// escaped with a backslash, so `to="https://example.com/?a=1;b=2"` and
+// `to=https://example.com/?a=1\;b=2` are the same value.
+func splitTxtv1(str string) ([]txtField, error) {
+	offset := func(i int) int {
+		return utf8.RuneCountInString(str[:i])
+	}
+
+	var fields []txtField
+	for i := 0; i < len(str); {
+		start := i
+		for i < len(str) && str[i] != '=' && str[i] != ';' {
+			i++
+		}
+		key := str[start:i]
+		if key == "" {
+			return nil, &RecordError{"", offset(start), "empty key"}
+		}
+		for j, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return nil, &RecordError{"", offset(start + j), fmt.Sprintf("invalid character %q in key", c)}
+			}
+		}
+		if i == len(str) || str[i] != '=' {
+			return nil, &RecordError{key, offset(i), "missing '=' after the key"}
+		}
+		i++
+
+		var value strings.Builder
+		if i < len(str) && str[i] == '"' {
+			quote := i
+			i++
+			closed := false
+			for i < len(str) && !closed {
+				switch str[i] {
+				case '\\':
+					if i+1 == len(str) {
+						return nil, &RecordError{key, offset(i), "unterminated escape"}
+					}
+					value.WriteByte(str[i+1])
+					i += 2
+				case '"':
+					closed = true
+					i++
+				default:
+					value.WriteByte(str[i])
+					i++
+				}
+			}
+			if !closed {
+				return nil, &RecordError{key, offset(quote), "unterminated quoted value"}
+			}
+			if i < len(str) && str[i] != ';' {
+				return nil, &RecordError{key, offset(i), "unexpected character after quoted value"}
+			}
+		} else {
+			for i < len(str) && str[i] != ';' {
+				switch str[i] {
+				case '\\':
+					if i+1 == len(str) {
+						return nil, &RecordError{key, offset(i), "unterminated escape"}
+					}
+					value.WriteByte(str[i+1])
+					i += 2
+				case '"':
+					return nil, &RecordError{key, offset(i), "unexpected quote in unquoted value"}
+				default:
+					value.WriteByte(str[i])
+					i++
+				}
+			}
+		}
+		fields = append(fields, txtField{key, value.String(), offset(start)})
+		// Skip the separator, a trailing one is allowed
+		i++
+	}
+	return fields, nil
+}
+
+// parseTxtv1 parses a record using the strict txtv1 grammar and
+// validates every field. Unknown keys are rejected unless they start
+// with "x-", which is reserved for extensions and ignored.
+func (r *record) parseTxtv1(str string, req *http.Request, c Config) error {
+	fields, err := splitTxtv1(str)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for i, f := range fields {
+		if seen[f.key] {
+			return &RecordError{f.key, f.offset, "duplicate field"}
+		}
+		seen[f.key] = true
+		if len(f.value) > 255 {
+			return &RecordError{f.key, f.offset, "TXT record cannot exceed the maximum of 255 characters"}
+		}
+
+		switch f.key {
+		case "v":
+			if i != 0 || f.value != "txtv1" {
+				return &RecordError{f.key, f.offset, "v=txtv1 must be the first field"}
+			}
+			r.Version = f.value
+
+		case "case", "slash", "slashes":
+			if err := validatePolicy(f.key, f.value); err != nil {
+				return &RecordError{f.key, f.offset, err.Error()}
+			}
+			switch f.key {
+			case "case":
+				r.Case = f.value
+			case "slash":
+				r.Slash = f.value
+			case "slashes":
+				r.Slashes = f.value
+			}
+
+		case "code":
+			code, err := strconv.Atoi(f.value)
+			if err != nil || code < 300 || code > 399 {
+				return &RecordError{f.key, f.offset, fmt.Sprintf("status code %q must be a number between 300 and 399", f.value)}
+			}
+			r.Code = code
+
+		case "enc":
+			if f.value != PathEncodingHex {
+				return &RecordError{f.key, f.offset, fmt.Sprintf("unknown path encoding %q", f.value)}
+			}
+			r.Enc = f.value
+
+		case "from":
+			r.From = f.value
+
+		case "match":
+			if _, err := compileGlob(f.value); err != nil {
+				return &RecordError{f.key, f.offset, err.Error()}
+			}
+			r.Match = f.value
+
+		case "priority":
+			priority, err := strconv.Atoi(f.value)
+			if err != nil || priority < 0 {
+				return &RecordError{f.key, f.offset, fmt.Sprintf("priority %q must be a non-negative number", f.value)}
+			}
+			r.Priority = priority
+
+		case "re":
+			if _, err := compileRegex(f.value); err != nil {
+				return &RecordError{f.key, f.offset, err.Error()}
+			}
+			r.Re = f.value
+
+		case "root", "website":
+			if err := validateURL(f.value, true); err != nil {
+				return &RecordError{f.key, f.offset, err.Error()}
+			}
+			if f.key == "root" {
+				r.Root = f.value
+			} else {
+				r.Website = f.value
+			}
+
+		case "to":
+			if err := validateURL(f.value, false); err != nil {
+				return &RecordError{f.key, f.offset, err.Error()}
+			}
+			r.To = f.value
+
+		case "type":
+			if !contains(recordTypes, f.value) {
+				return &RecordError{f.key, f.offset, fmt.Sprintf("unknown type %q", f.value)}
+			}
+			r.Type = f.value
+
+		case "vcs":
+			r.Vcs = f.value
+
+		default:
+			if !strings.HasPrefix(f.key, "x-") {
+				return &RecordError{f.key, f.offset, "unknown field"}
+			}
+		}
+	}
+	return nil
+}
+
+// policyValues are the permitted values of the path policy fields
+var policyValues = map[string][]string{
+	"case":    {"sensitive", "insensitive"},
+	"slash":   {SlashIgnore, SlashRedirectAdd, SlashRedirectStrip},
+	"slashes": {"keep", "merge"},
+}
+
+// validatePolicy checks the value of a path policy field
+func validatePolicy(key, value string) error {
+	if !contains(policyValues[key], value) {
+		return fmt.Errorf("%q must be one of %s", value, strings.Join(policyValues[key], ", "))
+	}
+	return nil
+}
+
+// validateURL checks the syntax of a URL field. Relative URLs are
+// only accepted when absolute is false. Placeholders are expanded for
+// each request, so they're checked as a plain label.
+func validateURL(value string, absolute bool) error {
+	if value == "" {
+		return fmt.Errorf("URL is empty")
+	}
+	if strings.ContainsAny(value, " \t\r\n") {
+		return fmt.Errorf("URL %q contains whitespace", value)
+	}
+	u, err := url.Parse(PlaceholderRegex.ReplaceAllString(value, "placeholder"))
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %s", value, err)
+	}
+	if absolute && (u.Scheme == "" || u.Host == "") {
+		return fmt.Errorf("URL %q must be absolute", value)
+	}
+	if u.Scheme != "" && u.Host == "" && u.Opaque == "" {
+		return fmt.Errorf("URL %q doesn't have a host", value)
+	}
+	return nil
+}
+
+// txtv1Field returns the value of the given field in a txtv1 record
+func txtv1Field(str, key string) string {
+	fields, err := splitTxtv1(str)
+	if err != nil {
+		return ""
+	}
+	for _, f := range fields {
+		if f.key == key {
+			return f.value
+		}
+	}
+	return ""
+}
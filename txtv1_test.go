@@ -0,0 +1,127 @@
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTxtv1(t *testing.T) {
+	tests := []struct {
+		txt      string
+		expected record
+		err      string
+	}{
+		{
+			txt: `v=txtv1;to="https://example.com/search?q=a;b=c";code=301;type=host`,
+			expected: record{
+				Version: "txtv1",
+				To:      "https://example.com/search?q=a;b=c",
+				Code:    301,
+				Type:    "host",
+			},
+		},
+		{
+			txt: `v=txtv1;to=https://example.com/?a=1\;b=2;x-owner=ops;`,
+			expected: record{
+				Version: "txtv1",
+				To:      "https://example.com/?a=1;b=2",
+				Code:    302,
+				Type:    "host",
+			},
+		},
+		{
+			txt: `v=txtv1;type=path;root=https://example.com;to="https://fallback.example.com/say \"hi\"";re="^/(?P<a>\\w+)$"`,
+			err: `invalid to= field at offset 43: URL "https://fallback.example.com/say \"hi\"" contains whitespace`,
+		},
+		{
+			txt: `v=txtv1;type=path;root=https://example.com;re="^/(?P<a>\\w+)$"`,
+			expected: record{
+				Version: "txtv1",
+				Code:    302,
+				Type:    "path",
+				Root:    "https://example.com",
+				Re:      `^/(?P<a>\w+)$`,
+			},
+		},
+		{
+			// Placeholders can be used in the host
+			txt: "v=txtv1;to=https://{label1}.example.org/{uri};website=https://{host}/x;type=host",
+			expected: record{
+				Version: "txtv1",
+				To:      "https://{label1}.example.org/{uri}",
+				Website: "https://{host}/x",
+				Code:    302,
+				Type:    "host",
+			},
+		},
+		{
+			txt: "v=txtv1;to=https://example.com/" + strings.Repeat("a", 250),
+			err: "invalid to= field at offset 8: TXT record cannot exceed the maximum of 255 characters",
+		},
+		{
+			txt: "v=txtv1;to=https://example.com;code=200",
+			err: `invalid code= field at offset 31: status code "200" must be a number between 300 and 399`,
+		},
+		{
+			txt: "v=txtv1;to=https://example.com;root=/relative",
+			err: `invalid root= field at offset 31: URL "/relative" must be absolute`,
+		},
+		{
+			txt: "v=txtv1;to=https://example.com;match=blog/*",
+			err: `invalid match= field at offset 31: glob "blog/*" must start with "/"`,
+		},
+		{
+			txt: "v=txtv1;to=https://example.com;slash=add",
+			err: `invalid slash= field at offset 31: "add" must be one of ignore, redirect-add, redirect-strip`,
+		},
+		{
+			txt: "v=txtv1;to=https://example.com;color=blue",
+			err: "invalid color= field at offset 31: unknown field",
+		},
+		{
+			txt: "v=txtv1;to=https://example.com;to=https://example.org",
+			err: "invalid to= field at offset 31: duplicate field",
+		},
+		{
+			txt: `v=txtv1;to="https://example.com`,
+			err: "invalid to= field at offset 11: unterminated quoted value",
+		},
+		{
+			txt: `v=txtv1;to="https://example.com"x`,
+			err: "invalid to= field at offset 32: unexpected character after quoted value",
+		},
+		{
+			txt: "v=txtv1;to=https://exämple.com;;type=host",
+			err: "invalid record at offset 31: empty key",
+		},
+		{
+			txt: "v=txtv1;https://example.com",
+			err: "invalid record at offset 13: invalid character ':' in key",
+		},
+		{
+			txt: "v=txtv1;type=redirect",
+			err: `invalid type= field at offset 8: unknown type "redirect"`,
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com", nil)
+		c := Config{Enable: []string{"host", "path"}}
+
+		rec := record{}
+		err := rec.Parse(test.txt, req, c)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("Test %d: Expected error %q, got %v", i, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, rec)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2017 - The TXTdirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream selection policies
+const (
+	PolicySequential = "sequential"
+	PolicyRandom     = "random"
+	PolicyRace       = "race"
+)
+
+const (
+	DefaultResolverTimeout = 2 * time.Second
+	DefaultMaxFails        = 3
+	DefaultDowntime        = 30 * time.Second
+)
+
+// resolverHealth keeps track of the upstream resolvers' failures.
+// It's shared between all of the sites since the resolvers'
+// health doesn't depend on the site that queries them.
+var resolverHealth = &upstreamHealth{
+	state: make(map[string]*upstreamState),
+}
+
+type upstreamHealth struct {
+	sync.Mutex
+	state map[string]*upstreamState
+}
+
+type upstreamState struct {
+	fails     int
+	downUntil time.Time
+}
+
+// upstreamResult is the answer of a single upstream resolver
+type upstreamResult struct {
+	resp     *dns.Msg
+	upstream string
+	err      error
+}
+
+// resolvers returns the list of upstream resolvers for the config
+func (c Config) resolvers() []string {
+	if len(c.DNS.Upstreams) > 0 {
+		return c.DNS.Upstreams
+	}
+	return []string{c.Resolver}
+}
+
+// exchangeUpstreams sends the given DNS query to the configured upstream
+// resolvers using the selection policy and returns the first answer
+// along with the upstream that answered it.
+func exchangeUpstreams(ctx context.Context, m *dns.Msg, c Config) (*dns.Msg, string, error) {
+	candidates := resolverHealth.order(c.resolvers(), time.Now())
+
+	switch c.DNS.Policy {
+	case PolicyRace:
+		return raceUpstreams(ctx, m, candidates, c.DNS)
+	case PolicyRandom:
+		// Down upstreams are still tried last
+		healthy := resolverHealth.healthy(candidates, time.Now())
+		rand.Shuffle(healthy, func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+
+	var result upstreamResult
+	for _, upstream := range candidates {
+		result = exchangeUpstream(ctx, m, upstream, c.DNS)
+		if result.err == nil || ctx.Err() != nil {
+			break
+		}
+		log.Printf("[txtdirect]: %s", result.err)
+	}
+	return result.resp, result.upstream, result.err
+}
+
+// raceUpstreams sends the query to all of the healthy upstreams at the
+// same time and returns the first successful answer
+func raceUpstreams(ctx context.Context, m *dns.Msg, candidates []string, opts DNS) (*dns.Msg, string, error) {
+	healthy := resolverHealth.healthy(candidates, time.Now())
+	if healthy == 0 {
+		healthy = len(candidates)
+	}
+	candidates = candidates[:healthy]
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan upstreamResult, len(candidates))
+	for _, upstream := range candidates {
+		go func(upstream string) {
+			results <- exchangeUpstream(ctx, m.Copy(), upstream, opts)
+		}(upstream)
+	}
+
+	var result upstreamResult
+	for range candidates {
+		result = <-results
+		if result.err == nil {
+			return result.resp, result.upstream, nil
+		}
+	}
+	return nil, result.upstream, result.err
+}
+
+// exchangeUpstream sends the query to a single upstream using the
+// per-attempt timeout and keeps track of the upstream's health
+func exchangeUpstream(ctx context.Context, m *dns.Msg, upstream string, opts DNS) upstreamResult {
+	attemptCtx, cancel := context.WithTimeout(ctx, opts.timeout())
+	defer cancel()
+
+	resp, err := exchange(attemptCtx, m, upstream, opts)
+	// A failed DNSSEC validation is an answer, the upstream works
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure && dnssecFailure(resp) == nil || resp.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("server misbehaving: %s", dns.RcodeToString[resp.Rcode])
+	}
+	if err != nil {
+		// Don't blame the upstream when the request itself was canceled
+		if ctx.Err() == nil {
+			resolverHealth.failure(upstream, opts.maxFails(), opts.downtime(), time.Now())
+		}
+		return upstreamResult{resp, upstream, &UpstreamError{upstream, err}}
+	}
+	resolverHealth.success(upstream)
+	return upstreamResult{resp, upstream, nil}
+}
+
+// order returns the given upstreams with the ones that are marked
+// as down moved to the end of the list
+func (h *upstreamHealth) order(list []string, now time.Time) []string {
+	h.Lock()
+	defer h.Unlock()
+
+	ordered := make([]string, 0, len(list))
+	var down []string
+	for _, upstream := range list {
+		if state, ok := h.state[upstream]; ok && now.Before(state.downUntil) {
+			down = append(down, upstream)
+			continue
+		}
+		ordered = append(ordered, upstream)
+	}
+	return append(ordered, down...)
+}
+
+// healthy returns the number of upstreams in the list that aren't down.
+// The list must be sorted using order.
+func (h *upstreamHealth) healthy(list []string, now time.Time) int {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, upstream := range list {
+		if state, ok := h.state[upstream]; ok && now.Before(state.downUntil) {
+			return i
+		}
+	}
+	return len(list)
+}
+
+// failure records a failed query and marks the upstream as down
+// for the downtime after maxFails consecutive failures
+func (h *upstreamHealth) failure(upstream string, maxFails int, downtime time.Duration, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	state, ok := h.state[upstream]
+	if !ok {
+		state = &upstreamState{}
+		h.state[upstream] = state
+	}
+	state.fails++
+	if state.fails >= maxFails {
+		log.Printf("[txtdirect]: resolver %s failed %d times, marking it down for %s", upstream, state.fails, downtime)
+		state.fails = 0
+		state.downUntil = now.Add(downtime)
+	}
+}
+
+func (h *upstreamHealth) success(upstream string) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.state, upstream)
+}
+
+func (d DNS) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return DefaultResolverTimeout
+	}
+	return d.Timeout
+}
+
+func (d DNS) maxFails() int {
+	if d.MaxFails == 0 {
+		return DefaultMaxFails
+	}
+	return d.MaxFails
+}
+
+func (d DNS) downtime() time.Duration {
+	if d.Downtime == 0 {
+		return DefaultDowntime
+	}
+	return d.Downtime
+}
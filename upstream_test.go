@@ -0,0 +1,70 @@
+package txtdirect
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	h := &upstreamHealth{state: make(map[string]*upstreamState)}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		h.failure("a", 2, time.Minute, now)
+	}
+	h.failure("b", 2, time.Minute, now)
+
+	order := h.order([]string{"a", "b", "c"}, now)
+	if !reflect.DeepEqual(order, []string{"b", "c", "a"}) {
+		t.Errorf("Expected down upstream to be tried last, got %v", order)
+	}
+	if healthy := h.healthy(order, now); healthy != 2 {
+		t.Errorf("Expected 2 healthy upstreams, got %d", healthy)
+	}
+
+	// Upstreams are tried in order again once the downtime ends
+	order = h.order([]string{"a", "b", "c"}, now.Add(2*time.Minute))
+	if !reflect.DeepEqual(order, []string{"a", "b", "c"}) {
+		t.Errorf("Expected upstream to be back after the downtime, got %v", order)
+	}
+
+	// A successful query resets the failures
+	h.success("b")
+	h.failure("b", 2, time.Minute, now)
+	if healthy := h.healthy([]string{"b"}, now); healthy != 1 {
+		t.Errorf("Expected upstream to be healthy after a success")
+	}
+}
+
+func Test_queryUpstreams(t *testing.T) {
+	// Nothing listens on the first upstream
+	upstreams := []string{"127.0.0.1:1", "127.0.0.1:" + strconv.Itoa(port)}
+	zone := "_redirect.about.test."
+
+	for _, policy := range []string{PolicySequential, PolicyRandom, PolicyRace} {
+		c := Config{
+			Resolver: upstreams[0],
+			DNS: DNS{
+				Upstreams: upstreams,
+				Policy:    policy,
+				Timeout:   time.Second,
+				MaxFails:  1,
+			},
+		}
+		resp, err := query(zone, context.Background(), c)
+		if err != nil {
+			t.Errorf("%s: Expected the healthy upstream to answer, got %s", policy, err)
+			continue
+		}
+		if resp[0] != txts[zone] {
+			t.Errorf("%s: Expected %s, got %s", policy, txts[zone], resp[0])
+		}
+	}
+
+	if order := resolverHealth.order(upstreams, time.Now()); order[0] != upstreams[1] {
+		t.Errorf("Expected the failing upstream to be marked down, got %v", order)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2017 - The TXTdirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const zoneFileCheckInterval = 5 * time.Second
+
+// ZoneFileSource serves the TXT records of an RFC 1035 zone file.
+// The file is checked for changes in the background and reloaded
+// when it's modified, the last loaded records are kept if the new
+// version can't be parsed.
+type ZoneFileSource struct {
+	Path   string
+	Origin string
+
+	sync.RWMutex
+	records map[string][]string
+	modTime time.Time
+	stop    chan struct{}
+}
+
+// NewZoneFileSource loads the zone file and starts watching it for
+// changes. The origin is used for relative names when the file
+// doesn't set $ORIGIN.
+func NewZoneFileSource(path, origin string) (*ZoneFileSource, error) {
+	if origin != "" {
+		origin = dns.Fqdn(origin)
+	}
+	s := &ZoneFileSource{Path: path, Origin: origin, stop: make(chan struct{})}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.watch(zoneFileCheckInterval)
+	return s, nil
+}
+
+// Records returns the TXT records of the zone found in the zone file
+func (s *ZoneFileSource) Records(ctx context.Context, zone string) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	txts, ok := s.records[absoluteZone(zone)]
+	if !ok {
+		return nil, NotFoundError(zone)
+	}
+	return append([]string{}, txts...), nil
+}
+
+// load parses the zone file and replaces the records
+func (s *ZoneFileSource) load() error {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	records := make(map[string][]string)
+	zp := dns.NewZoneParser(file, s.Origin, s.Path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		zone := absoluteZone(txt.Hdr.Name)
+		// Join the strings the same way the DNS lookups do
+		records[zone] = append(records[zone], strings.Join(txt.Txt, ""))
+	}
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("could not parse zone file %s: %s", s.Path, err)
+	}
+
+	s.Lock()
+	s.records = records
+	s.modTime = info.ModTime()
+	s.Unlock()
+	return nil
+}
+
+// Close stops watching the zone file
+func (s *ZoneFileSource) Close() error {
+	close(s.stop)
+	return nil
+}
+
+// watch reloads the zone file whenever its modification time changes
+func (s *ZoneFileSource) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		info, err := os.Stat(s.Path)
+		if err != nil {
+			log.Printf("[txtdirect]: couldn't check zone file %s: %s", s.Path, err)
+			continue
+		}
+		s.RLock()
+		modified := !info.ModTime().Equal(s.modTime)
+		s.RUnlock()
+		if !modified {
+			continue
+		}
+
+		if err := s.load(); err != nil {
+			log.Printf("[txtdirect]: couldn't reload zone file, keeping the previous records: %s", err)
+			// Don't retry until the file changes again
+			s.Lock()
+			s.modTime = info.ModTime()
+			s.Unlock()
+			continue
+		}
+		log.Printf("[txtdirect]: reloaded zone file %s", s.Path)
+	}
+}
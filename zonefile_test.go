@@ -0,0 +1,117 @@
+package txtdirect
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testZoneFile = `$ORIGIN example.com.
+$TTL 300
+@                IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300
+_redirect        IN TXT "v=txtv0;to=https://example.org;type=host"
+_redirect._      IN TXT "v=txtv0;to=https://wildcard.example.org;" "type=host"
+_redirect.path   IN TXT "v=txtv0;type=path"
+www              IN A   192.0.2.1
+`
+
+func TestZoneFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db.example.com")
+	if err := ioutil.WriteFile(path, []byte(testZoneFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := NewZoneFileSource(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	txts, err := source.Records(context.Background(), "_redirect.example.com.")
+	if err != nil || !reflect.DeepEqual(txts, []string{"v=txtv0;to=https://example.org;type=host"}) {
+		t.Errorf("Expected record for _redirect.example.com., got %v, %v", txts, err)
+	}
+	if _, err := source.Records(context.Background(), "www.example.com."); !IsNotFound(err) {
+		t.Errorf("Expected not found error for zone without TXT records, got %v", err)
+	}
+
+	// Wildcards are resolved the same way as DNS records
+	c := Config{Enable: []string{"host"}, Source: source}
+	req := httptest.NewRequest("GET", "https://sub.example.com/", nil)
+	rec, err := getRecord("sub.example.com", context.Background(), c, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.To != "https://wildcard.example.org" {
+		t.Errorf("Expected wildcard record, got %+v", rec)
+	}
+
+	if _, err := NewZoneFileSource(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Errorf("Expected error for missing zone file")
+	}
+}
+
+func TestZoneFileSourceReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db.example.com")
+	if err := ioutil.WriteFile(path, []byte(`_redirect IN TXT "v=txtv0;to=https://old.example.org"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := &ZoneFileSource{Path: path, Origin: "example.com.", stop: make(chan struct{})}
+	if err := source.load(); err != nil {
+		t.Fatal(err)
+	}
+	go source.watch(10 * time.Millisecond)
+	defer source.Close()
+
+	records := func() string {
+		txts, _ := source.Records(context.Background(), "_redirect.example.com.")
+		if len(txts) == 0 {
+			return ""
+		}
+		return txts[0]
+	}
+	waitFor := func(expected string) {
+		for i := 0; i < 100 && records() != expected; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := records(); got != expected {
+			t.Errorf("Expected %s after reload, got %s", expected, got)
+		}
+	}
+
+	update := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the modification time changes on coarse filesystems
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update(`_redirect IN TXT "v=txtv0;to=https://new.example.org"`, time.Now().Add(time.Minute))
+	waitFor("v=txtv0;to=https://new.example.org")
+
+	// Invalid zone files don't replace the loaded records
+	update(`_redirect IN TXT`, time.Now().Add(2*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if got := records(); got != "v=txtv0;to=https://new.example.org" {
+		t.Errorf("Expected previous records to be kept, got %s", got)
+	}
+}